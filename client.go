@@ -0,0 +1,66 @@
+package docker
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	dockerClient "github.com/docker/docker/client"
+)
+
+// dockerAPI is the part of the docker API the plugin uses. It is satisfied
+// by *client.Client and by the in-memory daemon of the dockertest package.
+type dockerAPI interface {
+	ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error)
+	ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error)
+	NetworkInspect(ctx context.Context, networkID string, options types.NetworkInspectOptions) (types.NetworkResource, error)
+	Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error)
+	Close() error
+}
+
+// newDockerClient returns a client for the docker endpoint of the instance.
+// The API version is negotiated with the daemon on the first call, unless
+// pinned by DOCKER_API_VERSION with from_env.
+func (dd *Discovery) newDockerClient() (dockerAPI, error) {
+	if strings.HasPrefix(dd.dockerEndpoint, "ssh://") {
+		apiVersion := ""
+		if dd.clientFromEnv {
+			apiVersion = os.Getenv("DOCKER_API_VERSION")
+		}
+		return newSSHClient(dd.dockerEndpoint, dd.sshKey, dd.sshKnownHosts, apiVersion)
+	}
+	if dd.clientFromEnv {
+		// FromEnv pins the version given by DOCKER_API_VERSION, which
+		// disables the negotiation
+		return dockerClient.NewClientWithOpts(dockerClient.FromEnv, dockerClient.WithAPIVersionNegotiation())
+	}
+	var opts []dockerClient.Opt
+	if dd.tls != nil { // before WithHost, which configures the transport it replaces
+		opts = append(opts, withTLS(*dd.tls))
+	}
+	opts = append(opts,
+		dockerClient.WithHost(dd.dockerEndpoint),
+		dockerClient.WithAPIVersionNegotiation(),
+	)
+	return dockerClient.NewClientWithOpts(opts...)
+}
+
+// normalizeNetworkSettings fills in the default network settings daemons
+// dropping the deprecated top-level fields of NetworkSettings only report
+// for the "bridge" network, so they are found the same way whatever the API
+// version.
+func normalizeNetworkSettings(container *types.ContainerJSON) {
+	settings := container.NetworkSettings
+	if settings == nil || container.HostConfig == nil || settings.IPAddress != "" || settings.GlobalIPv6Address != "" {
+		return
+	}
+	if networkMode := container.HostConfig.NetworkMode; networkMode != "bridge" && networkMode != "default" {
+		return
+	}
+	if bridge, ok := settings.Networks["bridge"]; ok {
+		settings.IPAddress = bridge.IPAddress
+		settings.GlobalIPv6Address = bridge.GlobalIPv6Address
+	}
+}
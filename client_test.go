@@ -0,0 +1,142 @@
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/docker/docker/api/types"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// fixtureDaemon serves the responses recorded in testdata/api/VERSION for a
+// daemon of that API version, and records the API versions requested.
+type fixtureDaemon struct {
+	version   string
+	list      []byte
+	inspects  map[string][]byte // by container ID and name
+	mutex     sync.Mutex
+	requested map[string]bool
+}
+
+func newFixtureDaemon(t *testing.T, version string) *httptest.Server {
+	dir := filepath.Join("testdata", "api", version)
+	d := &fixtureDaemon{version: version, inspects: make(map[string][]byte), requested: make(map[string]bool)}
+	var err error
+	if d.list, err = ioutil.ReadFile(filepath.Join(dir, "containers.json")); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	for _, file := range files {
+		if filepath.Base(file) == "containers.json" {
+			continue
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var c types.ContainerJSON
+		if err = json.Unmarshal(data, &c); err != nil {
+			t.Fatalf("%s: %s", file, err)
+		}
+		d.inspects[c.ID] = data
+		d.inspects[strings.TrimPrefix(c.Name, "/")] = data
+	}
+
+	server := httptest.NewServer(d)
+	t.Cleanup(server.Close)
+	t.Cleanup(func() {
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+		for v := range d.requested {
+			if v != negotiatedVersion(version) {
+				t.Errorf("daemon %s got a request for API %s", version, v)
+			}
+		}
+	})
+	return server
+}
+
+// negotiatedVersion is the API version the client settles on with a daemon.
+func negotiatedVersion(daemon string) string {
+	if daemon > "1.41" { // the newest version of the client
+		return "1.41"
+	}
+	return daemon
+}
+
+func (d *fixtureDaemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/_ping" {
+		w.Header().Set("API-Version", d.version)
+		fmt.Fprint(w, "OK")
+		return
+	}
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/v"), "/", 2)
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	d.mutex.Lock()
+	d.requested[parts[0]] = true
+	d.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	switch path := parts[1]; {
+	case path == "containers/json":
+		w.Write(d.list)
+	case strings.HasPrefix(path, "containers/") && strings.HasSuffix(path, "/json"):
+		data, ok := d.inspects[strings.TrimSuffix(strings.TrimPrefix(path, "containers/"), "/json")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"message":"No such container"}`)
+			return
+		}
+		w.Write(data)
+	case path == "events":
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestAPIVersions(t *testing.T) {
+	for _, version := range []string{"1.24", "1.41", "1.52"} {
+		t.Run(version, func(t *testing.T) {
+			server := newFixtureDaemon(t, version)
+			c := caddy.NewTestController("dns", "docker "+strings.Replace(server.URL, "http://", "tcp://", 1)+" {\n domain docker.loc\n network_aliases backend\n}")
+			dnsserver.GetConfig(c).Zone = "docker.loc."
+			dd, err := createPlugin(c)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.NoError(t, dd.startup())
+			defer dd.shutdown()
+			assert.Eventually(t, dd.Ready, 5*time.Second, time.Millisecond)
+
+			for _, name := range []string{"web.docker.loc", "www.docker.loc", "sidecar.docker.loc"} {
+				_, m := lookup(dd, name, dns.TypeA)
+				assert.Equal(t, []string{"172.17.0.2"}, answerIPs(m), name)
+				_, m = lookup(dd, name, dns.TypeAAAA)
+				assert.Equal(t, []string{"2001:db8:1::2"}, answerIPs(m), name)
+			}
+
+			// The short container ID older daemons add to the aliases is no name.
+			info, _ := dd.containerInfoByDomain("web.docker.loc.")
+			if assert.NotNil(t, info) {
+				assert.ElementsMatch(t, []string{"www.docker.loc", "web.docker.loc", "web"}, info.domains)
+			}
+		})
+	}
+}
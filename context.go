@@ -0,0 +1,147 @@
+package docker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	dockerClient "github.com/docker/docker/client"
+	"github.com/docker/go-connections/tlsconfig"
+)
+
+// defaultDockerContext is the context of the docker CLI that stands for
+// DOCKER_HOST or the default docker socket rather than a stored context.
+const defaultDockerContext = "default"
+
+// dockerContextMeta is the meta.json of a context stored by the docker CLI.
+type dockerContextMeta struct {
+	Name      string `json:"Name"`
+	Endpoints map[string]struct {
+		Host          string `json:"Host"`
+		SkipTLSVerify bool   `json:"SkipTLSVerify"`
+	} `json:"Endpoints"`
+}
+
+// dockerConfigDir returns the configuration directory of the docker CLI.
+func dockerConfigDir() (string, error) {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return dir, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".docker"), nil
+}
+
+// currentDockerContext returns the context selected with "docker context
+// use", empty if there is none.
+func currentDockerContext(configDir string) (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(configDir, "config.json"))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	var config struct {
+		CurrentContext string `json:"currentContext"`
+	}
+	if err = json.Unmarshal(data, &config); err != nil {
+		return "", fmt.Errorf("unable to decode %s: %v", filepath.Join(configDir, "config.json"), err)
+	}
+	return config.CurrentContext, nil
+}
+
+// useDockerContext takes the endpoint and the TLS material of a context
+// stored by the docker CLI in configDir.
+func (dd *Discovery) useDockerContext(configDir, name string) error {
+	sum := sha256.Sum256([]byte(name))
+	id := hex.EncodeToString(sum[:])
+
+	metaFile := filepath.Join(configDir, "contexts", "meta", id, "meta.json")
+	data, err := ioutil.ReadFile(metaFile)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("docker context %s not found in %s", name, configDir)
+	}
+	if err != nil {
+		return err
+	}
+	var meta dockerContextMeta
+	if err = json.Unmarshal(data, &meta); err != nil {
+		return fmt.Errorf("unable to decode %s: %v", metaFile, err)
+	}
+	endpoint, ok := meta.Endpoints["docker"]
+	if !ok || endpoint.Host == "" {
+		return fmt.Errorf("docker context %s has no docker endpoint", name)
+	}
+	dd.dockerEndpoint = endpoint.Host
+
+	tlsDir := filepath.Join(configDir, "contexts", "tls", id, "docker")
+	tls := &tlsconfig.Options{InsecureSkipVerify: endpoint.SkipTLSVerify}
+	for file, path := range map[string]*string{"ca.pem": &tls.CAFile, "cert.pem": &tls.CertFile, "key.pem": &tls.KeyFile} {
+		if _, err := os.Stat(filepath.Join(tlsDir, file)); err == nil {
+			*path = filepath.Join(tlsDir, file)
+		}
+	}
+	if tls.CAFile != "" || tls.CertFile != "" || tls.InsecureSkipVerify {
+		dd.tls = tls
+	}
+	return nil
+}
+
+// useDockerEnv configures the endpoint like the docker CLI does from its
+// environment: DOCKER_HOST, handled by client.FromEnv, or else the context
+// named by DOCKER_CONTEXT or selected with "docker context use".
+func (dd *Discovery) useDockerEnv() error {
+	if dd.useDockerHost() {
+		return nil
+	}
+
+	configDir, err := dockerConfigDir()
+	if err != nil {
+		return err
+	}
+	name := os.Getenv("DOCKER_CONTEXT")
+	if name == "" {
+		if name, err = currentDockerContext(configDir); err != nil {
+			return err
+		}
+	}
+	if name == "" || name == defaultDockerContext {
+		return nil
+	}
+	return dd.useDockerContext(configDir, name)
+}
+
+// useDockerHost makes the client take its endpoint, TLS material and API
+// version from the environment with client.FromEnv when DOCKER_HOST is set,
+// as the docker CLI does for the default context. It reports whether it is.
+func (dd *Discovery) useDockerHost() bool {
+	host := os.Getenv("DOCKER_HOST")
+	if host == "" {
+		return false
+	}
+	dd.dockerEndpoint = host
+	dd.clientFromEnv = true
+	return true
+}
+
+// withTLS applies TLS options to the transport of the docker client.
+func withTLS(options tlsconfig.Options) dockerClient.Opt {
+	return func(c *dockerClient.Client) error {
+		config, err := tlsconfig.Client(options)
+		if err != nil {
+			return fmt.Errorf("failed to create tls config: %v", err)
+		}
+		return dockerClient.WithHTTPClient(&http.Client{
+			Transport:     &http.Transport{TLSClientConfig: config},
+			CheckRedirect: dockerClient.CheckRedirect,
+		})(c)
+	}
+}
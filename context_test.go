@@ -0,0 +1,197 @@
+package docker
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/docker/docker/client"
+	"github.com/stretchr/testify/assert"
+)
+
+// setenv sets an environment variable for the duration of the test.
+func setenv(t *testing.T, key, value string) {
+	previous, ok := os.LookupEnv(key)
+	if value == "" {
+		os.Unsetenv(key)
+	} else {
+		os.Setenv(key, value)
+	}
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, previous)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+// writeDockerContext stores a context like "docker context create" does and
+// returns the directory of its TLS material.
+func writeDockerContext(t *testing.T, configDir, name, host string) string {
+	sum := sha256.Sum256([]byte(name))
+	id := hex.EncodeToString(sum[:])
+	metaDir := filepath.Join(configDir, "contexts", "meta", id)
+	tlsDir := filepath.Join(configDir, "contexts", "tls", id, "docker")
+	for _, dir := range []string{metaDir, tlsDir} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	meta := fmt.Sprintf(`{"Name":%q,"Metadata":{"Description":"test"},"Endpoints":{"docker":{"Host":%q,"SkipTLSVerify":false}}}`, name, host)
+	if err := ioutil.WriteFile(filepath.Join(metaDir, "meta.json"), []byte(meta), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return tlsDir
+}
+
+// writeTLSMaterial writes the certificate of a TLS test server as ca.pem and
+// cert.pem, and its key as key.pem, to dir.
+func writeTLSMaterial(t *testing.T, dir string, server *httptest.Server) {
+	cert := server.TLS.Certificates[0]
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	for file, data := range map[string][]byte{
+		"ca.pem":   certPEM,
+		"cert.pem": certPEM,
+		"key.pem":  pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}),
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, file), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDockerContext(t *testing.T) {
+	connected := make(chan struct{}, 1)
+	server := httptest.NewTLSServer(eventStreamHandler(connected))
+	t.Cleanup(server.Close)
+
+	configDir := t.TempDir()
+	setenv(t, "DOCKER_CONFIG", configDir)
+	tlsDir := writeDockerContext(t, configDir, "remote", strings.Replace(server.URL, "https://", "tcp://", 1))
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(tlsDir, "ca.pem"), ca, 0600))
+
+	dd, err := createPlugin(caddy.NewTestController("dns", "docker {\n context remote\n}"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, strings.Replace(server.URL, "https://", "tcp://", 1), dd.dockerEndpoint)
+	if assert.NotNil(t, dd.tls) {
+		assert.Equal(t, filepath.Join(tlsDir, "ca.pem"), dd.tls.CAFile)
+		assert.Equal(t, "", dd.tls.CertFile)
+	}
+
+	assert.NoError(t, dd.startup())
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("event stream was not opened over TLS")
+	}
+	assert.Eventually(t, dd.Ready, 5*time.Second, time.Millisecond)
+	assert.NoError(t, dd.shutdown())
+}
+
+func TestFromEnv(t *testing.T) {
+	connected := make(chan struct{}, 1)
+	server := httptest.NewTLSServer(eventStreamHandler(connected))
+	t.Cleanup(server.Close)
+	certPath := t.TempDir()
+	writeTLSMaterial(t, certPath, server)
+
+	configDir := t.TempDir()
+	writeDockerContext(t, configDir, "remote", "tcp://10.0.0.2:2376")
+	setenv(t, "DOCKER_CONFIG", configDir)
+
+	fromEnv := func() *Discovery {
+		dd, err := createPlugin(caddy.NewTestController("dns", "docker {\n from_env\n}"))
+		assert.NoError(t, err)
+		return dd
+	}
+
+	host := strings.Replace(server.URL, "https://", "tcp://", 1)
+	setenv(t, "DOCKER_HOST", host)
+	setenv(t, "DOCKER_CONTEXT", "remote")
+	setenv(t, "DOCKER_API_VERSION", "1.40")
+	setenv(t, "DOCKER_CERT_PATH", certPath)
+	setenv(t, "DOCKER_TLS_VERIFY", "1")
+	dd := fromEnv()
+	assert.Equal(t, host, dd.dockerEndpoint)
+	assert.True(t, dd.clientFromEnv)
+
+	assert.NoError(t, dd.startup())
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("event stream was not opened over TLS")
+	}
+	assert.Eventually(t, dd.Ready, 5*time.Second, time.Millisecond)
+	if c, ok := dd.dockerClient.(*client.Client); assert.True(t, ok) {
+		assert.Equal(t, "1.40", c.ClientVersion())
+	}
+	assert.NoError(t, dd.shutdown())
+
+	// Without DOCKER_HOST the context is taken from DOCKER_CONTEXT, or else
+	// the one selected with "docker context use".
+	setenv(t, "DOCKER_HOST", "")
+	setenv(t, "DOCKER_API_VERSION", "")
+	dd = fromEnv()
+	assert.Equal(t, "tcp://10.0.0.2:2376", dd.dockerEndpoint)
+	assert.False(t, dd.clientFromEnv)
+
+	setenv(t, "DOCKER_CONTEXT", "")
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(configDir, "config.json"), []byte(`{"currentContext":"remote"}`), 0600))
+	assert.Equal(t, "tcp://10.0.0.2:2376", fromEnv().dockerEndpoint)
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(configDir, "config.json"), []byte(`{"currentContext":"default"}`), 0600))
+	assert.Equal(t, client.DefaultDockerHost, fromEnv().dockerEndpoint)
+}
+
+func TestDefaultDockerContext(t *testing.T) {
+	setenv(t, "DOCKER_CONFIG", t.TempDir())
+	defaultContext := func() *Discovery {
+		dd, err := createPlugin(caddy.NewTestController("dns", "docker {\n context default\n}"))
+		assert.NoError(t, err)
+		return dd
+	}
+
+	// Like the docker CLI, the default context stands for DOCKER_HOST.
+	setenv(t, "DOCKER_HOST", "tcp://10.0.0.1:2375")
+	dd := defaultContext()
+	assert.Equal(t, "tcp://10.0.0.1:2375", dd.dockerEndpoint)
+	assert.True(t, dd.clientFromEnv)
+
+	setenv(t, "DOCKER_HOST", "")
+	dd = defaultContext()
+	assert.Equal(t, client.DefaultDockerHost, dd.dockerEndpoint)
+	assert.False(t, dd.clientFromEnv)
+}
+
+func TestDockerContextSetup(t *testing.T) {
+	setenv(t, "DOCKER_CONFIG", t.TempDir())
+	for _, config := range []string{
+		"docker {\n context\n}",
+		"docker {\n context missing\n}",
+		"docker {\n from_env yes\n}",
+		"docker {\n from_env\n context remote\n}",
+		"docker unix:///var/run/docker.sock {\n from_env\n}",
+		"docker unix:///var/run/docker.sock {\n context remote\n}",
+	} {
+		_, err := createPlugin(caddy.NewTestController("dns", config))
+		assert.NotNil(t, err, config)
+	}
+}
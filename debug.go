@@ -0,0 +1,390 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/docker/docker/api/types"
+	"github.com/miekg/dns"
+)
+
+// debugShutdownTimeout bounds how long in-flight debug requests may delay a
+// reload or shutdown.
+const debugShutdownTimeout = 5 * time.Second
+
+// debugSnapshotResolver is reported as the source of names loaded from a
+// snapshot, which does not keep what the resolvers need to run again.
+const debugSnapshotResolver = "snapshot"
+
+type debugDomain struct {
+	Name      string   `json:"name"`
+	Resolvers []string `json:"resolvers"`
+	Conflicts []string `json:"conflicts,omitempty"` // IDs of other containers claiming the name
+}
+
+type debugNetwork struct {
+	IPAddress         string   `json:"ip_address,omitempty"`
+	GlobalIPv6Address string   `json:"global_ipv6_address,omitempty"`
+	Aliases           []string `json:"aliases,omitempty"`
+}
+
+type debugContainer struct {
+	ID        string                  `json:"id"`
+	Name      string                  `json:"name"`
+	Address   net.IP                  `json:"address,omitempty"`
+	AddressV6 net.IP                  `json:"address_v6,omitempty"`
+	Ports     []publishedPort         `json:"ports,omitempty"` // with host_ports
+	Domains   []debugDomain           `json:"domains,omitempty"`
+	Networks  map[string]debugNetwork `json:"networks,omitempty"`
+	TTL       uint32                  `json:"ttl,omitempty"`
+	Updated   time.Time               `json:"updated"`
+	Stopped   *time.Time              `json:"stopped,omitempty"` // with on_stop, when the container stopped
+	Skipped   string                  `json:"skipped,omitempty"` // why the container got no record
+}
+
+type debugRegistry struct {
+	Zones      []string         `json:"zones"`
+	Ready      bool             `json:"ready"`
+	Stale      bool             `json:"stale"`
+	Containers []debugContainer `json:"containers"`
+	Skipped    []debugContainer `json:"skipped"`
+}
+
+type debugLookup struct {
+	Name        string           `json:"name"`
+	Zone        string           `json:"zone"`
+	Records     []debugContainer `json:"records"`
+	Excluded    []debugContainer `json:"excluded"`
+	Explanation []string         `json:"explanation"`
+}
+
+// resolversOf returns the resolvers that produce each name of a container.
+func (dd *Discovery) resolversOf(container *types.ContainerJSON) map[string][]string {
+	sources := make(map[string][]string)
+	if container.Config == nil || container.NetworkSettings == nil {
+		return sources
+	}
+	for _, resolver := range dd.resolvers {
+		domains, err := resolver.resolve(container)
+		if err != nil {
+			continue
+		}
+		for _, d := range domains {
+			sources[d] = append(sources[d], fmt.Sprint(resolver))
+		}
+	}
+	return sources
+}
+
+// debugContainerOf describes a container, resolving the source of each of
+// its names. claims maps every registered name to the containers holding
+// it. The caller holds the read lock.
+func (dd *Discovery) debugContainerOf(container *types.ContainerJSON, domains []string, claims map[string][]string) debugContainer {
+	dc := debugContainer{
+		ID:   container.ID,
+		Name: normalizeContainerName(container),
+	}
+	if container.NetworkSettings != nil {
+		dc.Networks = make(map[string]debugNetwork, len(container.NetworkSettings.Networks))
+		for name, network := range container.NetworkSettings.Networks {
+			dc.Networks[name] = debugNetwork{
+				IPAddress:         network.IPAddress,
+				GlobalIPv6Address: network.GlobalIPv6Address,
+				Aliases:           network.Aliases,
+			}
+		}
+	}
+
+	sources := dd.resolversOf(container)
+	seen := make(map[string]bool, len(domains))
+	for _, d := range domains {
+		if seen[d] {
+			continue
+		}
+		seen[d] = true
+		entry := debugDomain{Name: d, Resolvers: sources[d]}
+		if len(entry.Resolvers) == 0 {
+			entry.Resolvers = []string{debugSnapshotResolver}
+		}
+		for _, id := range claims[d] {
+			if id != container.ID {
+				entry.Conflicts = append(entry.Conflicts, id)
+			}
+		}
+		dc.Domains = append(dc.Domains, entry)
+	}
+	return dc
+}
+
+// domainClaims maps every registered name to the IDs of the containers
+// holding it. The caller holds the read lock.
+func (dd *Discovery) domainClaims() map[string][]string {
+	claims := make(map[string][]string)
+	for id, info := range dd.containerInfoMap {
+		for _, d := range info.domains {
+			claims[d] = append(claims[d], id)
+		}
+	}
+	for _, ids := range claims {
+		sort.Strings(ids)
+	}
+	return claims
+}
+
+func (dd *Discovery) debugRegistry() debugRegistry {
+	stale, _ := dd.staleness()
+	reg := debugRegistry{
+		Zones:      dd.Zones,
+		Ready:      dd.Ready(),
+		Stale:      stale,
+		Containers: []debugContainer{},
+		Skipped:    []debugContainer{},
+	}
+
+	dd.mutex.RLock()
+	claims := dd.domainClaims()
+	for _, info := range dd.containerInfoMap {
+		dc := dd.debugContainerOf(info.container, info.domains, claims)
+		dc.Address, dc.AddressV6, dc.Ports = info.address, info.addressv6, info.ports
+		dc.TTL, dc.Updated = dd.TTL, info.updated
+		if !info.stopped.IsZero() {
+			dc.Stopped = &info.stopped
+		}
+		reg.Containers = append(reg.Containers, dc)
+	}
+	for _, skipped := range dd.skipped {
+		dc := dd.debugContainerOf(skipped.container, nil, claims)
+		dc.Skipped, dc.Updated = skipped.reason, skipped.updated
+		reg.Skipped = append(reg.Skipped, dc)
+	}
+	dd.mutex.RUnlock()
+
+	sortDebugContainers(reg.Containers)
+	sortDebugContainers(reg.Skipped)
+	return reg
+}
+
+// debugLookup explains how a name is answered: the records holding it, the
+// running containers that would hold it but got no record, and aliases that
+// network_aliases does not publish.
+func (dd *Discovery) debugLookup(name string) debugLookup {
+	qname := strings.ToLower(dns.Fqdn(name))
+	domain := strings.TrimSuffix(qname, ".")
+	lookup := debugLookup{
+		Name:        qname,
+		Zone:        plugin.Zones(dd.Zones).Matches(qname),
+		Records:     []debugContainer{},
+		Excluded:    []debugContainer{},
+		Explanation: []string{},
+	}
+	explain := func(format string, args ...interface{}) {
+		lookup.Explanation = append(lookup.Explanation, fmt.Sprintf(format, args...))
+	}
+	if lookup.Zone == "" {
+		explain("%s is outside the zones %s, queries are passed to the next plugin", qname, strings.Join(dd.Zones, ", "))
+	}
+
+	dd.mutex.RLock()
+	claims := dd.domainClaims()
+	for _, id := range claims[domain] {
+		info := dd.containerInfoMap[id]
+		dc := dd.debugContainerOf(info.container, info.domains, claims)
+		dc.Address, dc.AddressV6, dc.Ports = info.address, info.addressv6, info.ports
+		dc.TTL, dc.Updated = dd.TTL, info.updated
+		if !info.stopped.IsZero() {
+			dc.Stopped = &info.stopped
+		}
+		lookup.Records = append(lookup.Records, dc)
+		for _, d := range dc.Domains {
+			if d.Name == domain {
+				address, addressv6 := dd.addressesFor(info, domain)
+				explain("container %s (%s) holds the name through %s, A: %v, AAAA: %v", dc.Name, shortID(dc.ID), strings.Join(d.Resolvers, ", "), address, addressv6)
+			}
+		}
+	}
+	if len(lookup.Records) > 1 {
+		explain("%d containers claim the name, A and AAAA queries are answered with the addresses of all that run", len(lookup.Records))
+	}
+
+	for _, skipped := range dd.skipped {
+		sources := dd.resolversOf(skipped.container)
+		if resolvers, ok := sources[domain]; ok {
+			dc := dd.debugContainerOf(skipped.container, []string{domain}, claims)
+			dc.Skipped, dc.Updated = skipped.reason, skipped.updated
+			lookup.Excluded = append(lookup.Excluded, dc)
+			explain("container %s (%s) would hold the name through %s but has no record: %s", dc.Name, shortID(dc.ID), strings.Join(resolvers, ", "), skipped.reason)
+		}
+	}
+
+	for _, info := range dd.containerInfoMap {
+		if info.container.NetworkSettings == nil {
+			continue
+		}
+		for network, settings := range info.container.NetworkSettings.Networks {
+			for _, alias := range settings.Aliases {
+				if strings.EqualFold(alias, domain) && !dd.publishesAliases(network) {
+					explain("container %s (%s) has the alias on network %s, which network_aliases does not publish", normalizeContainerName(info.container), shortID(info.container.ID), network)
+				}
+			}
+		}
+	}
+	dd.mutex.RUnlock()
+
+	sortDebugContainers(lookup.Excluded)
+	if len(lookup.Records) == 0 && len(lookup.Excluded) == 0 && lookup.Zone != "" {
+		explain("no container produces the name with resolvers %s", dd.resolverNames())
+	}
+	return lookup
+}
+
+// publishesAliases reports whether network_aliases publishes the aliases a
+// container has on network.
+func (dd *Discovery) publishesAliases(network string) bool {
+	for _, resolver := range dd.resolvers {
+		if r, ok := resolver.(*networkAliasesResolver); ok && (r.network == "" || r.network == network) {
+			return true
+		}
+	}
+	return false
+}
+
+func (dd *Discovery) resolverNames() string {
+	names := make([]string, len(dd.resolvers))
+	for i, resolver := range dd.resolvers {
+		names[i] = fmt.Sprint(resolver)
+	}
+	return strings.Join(names, ", ")
+}
+
+func sortDebugContainers(containers []debugContainer) {
+	sort.Slice(containers, func(i, j int) bool {
+		if containers[i].Name != containers[j].Name {
+			return containers[i].Name < containers[j].Name
+		}
+		return containers[i].ID < containers[j].ID
+	})
+}
+
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+var debugIndexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head><title>docker {{ .Zones }}</title></head>
+<body>
+<p>Zones: {{ range .Zones }}{{ . }} {{ end }}&mdash; ready: {{ .Ready }}, stale: {{ .Stale }}</p>
+<form action="lookup"><input name="name" placeholder="name"> <input type="submit" value="lookup"></form>
+<h2>Records</h2>
+<table border="1">
+<tr><th>ID</th><th>Name</th><th>Names</th><th>A</th><th>AAAA</th><th>Networks</th><th>TTL</th><th>Updated</th></tr>
+{{ range .Containers }}<tr>
+<td>{{ .ID }}</td><td>{{ .Name }}</td>
+<td>{{ range .Domains }}{{ .Name }} ({{ range .Resolvers }}{{ . }}; {{ end }}){{ if .Conflicts }} <b>conflicts with {{ range .Conflicts }}{{ . }} {{ end }}</b>{{ end }}<br>{{ end }}</td>
+<td>{{ .Address }}</td><td>{{ .AddressV6 }}</td>
+<td>{{ range $name, $n := .Networks }}{{ $name }}: {{ $n.IPAddress }} {{ $n.GlobalIPv6Address }}<br>{{ end }}</td>
+<td>{{ .TTL }}</td><td>{{ .Updated.Format "2006-01-02T15:04:05Z07:00" }}</td>
+</tr>{{ end }}
+</table>
+<h2>Skipped</h2>
+<table border="1">
+<tr><th>ID</th><th>Name</th><th>Reason</th><th>Networks</th><th>Updated</th></tr>
+{{ range .Skipped }}<tr>
+<td>{{ .ID }}</td><td>{{ .Name }}</td><td>{{ .Skipped }}</td>
+<td>{{ range $name, $n := .Networks }}{{ $name }}: {{ $n.IPAddress }} {{ $n.GlobalIPv6Address }}<br>{{ end }}</td>
+<td>{{ .Updated.Format "2006-01-02T15:04:05Z07:00" }}</td>
+</tr>{{ end }}
+</table>
+</body>
+</html>
+`))
+
+// debugHandler serves the registry as HTML on /, as JSON on /registry and
+// explains a name on /lookup?name=.
+func (dd *Discovery) debugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := debugIndexTemplate.Execute(w, dd.debugRegistry()); err != nil {
+			log.Errorf("[zone/%s] Error rendering debug page: %s", dd.Zone, err)
+		}
+	})
+	mux.HandleFunc("/registry", func(w http.ResponseWriter, r *http.Request) {
+		writeDebugJSON(w, dd.debugRegistry())
+	})
+	mux.HandleFunc("/lookup", func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			http.Error(w, "missing name parameter", http.StatusBadRequest)
+			return
+		}
+		writeDebugJSON(w, dd.debugLookup(name))
+	})
+	return mux
+}
+
+func writeDebugJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Errorf("Error writing debug response: %s", err)
+	}
+}
+
+// startDebugHTTP starts serving the debug endpoint when debug_http is set.
+func (dd *Discovery) startDebugHTTP() error {
+	if dd.debugHTTP == "" {
+		return nil
+	}
+	ln, err := net.Listen("tcp", dd.debugHTTP)
+	if err != nil {
+		return fmt.Errorf("unable to listen for debug_http on %s: %v", dd.debugHTTP, err)
+	}
+	server := &http.Server{Handler: dd.debugHandler()}
+
+	dd.debugMutex.Lock()
+	dd.debugServer = server
+	dd.debugMutex.Unlock()
+
+	dd.wg.Add(1)
+	go func() {
+		defer dd.wg.Done()
+		if err := server.Serve(ln); err != http.ErrServerClosed {
+			log.Errorf("[zone/%s] debug_http on %s stopped: %s", dd.Zone, dd.debugHTTP, err)
+		}
+	}()
+	log.Infof("[zone/%s] Serving the registry on http://%s/", dd.Zone, ln.Addr())
+	return nil
+}
+
+// stopDebugHTTP stops the debug endpoint, releasing its address for the
+// instance started by a reload.
+func (dd *Discovery) stopDebugHTTP() error {
+	dd.debugMutex.Lock()
+	server := dd.debugServer
+	dd.debugServer = nil
+	dd.debugMutex.Unlock()
+	if server == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), debugShutdownTimeout)
+	defer cancel()
+	return server.Shutdown(ctx)
+}
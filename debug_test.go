@@ -0,0 +1,157 @@
+package docker
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/rb-coredns/coredns-docker-discovery/dockertest"
+	"github.com/stretchr/testify/assert"
+)
+
+// getDebug requests path from the debug endpoint of dd and decodes the
+// JSON response into v.
+func getDebug(t *testing.T, dd *Discovery, path string, v interface{}) {
+	rec := httptest.NewRecorder()
+	dd.debugHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), v))
+}
+
+func newDebugDaemon() *dockertest.Daemon {
+	daemon := dockertest.New()
+	daemon.AddNetwork("backend", "bridge")
+	daemon.AddNetwork("frontend", "bridge")
+	web := dockertest.NewContainer(dockertest.ContainerID(0), "web", dockertest.Endpoint{Network: "bridge", IPAddress: "172.17.0.2"})
+	web.Config.Labels["coredns.dockerdiscovery.host"] = "app.docker.loc"
+	daemon.Add(web)
+	api := dockertest.NewContainer(dockertest.ContainerID(1), "api", dockertest.Endpoint{
+		Network:   "backend",
+		IPAddress: "172.18.0.2",
+	}, dockertest.Endpoint{
+		Network:   "frontend",
+		IPAddress: "172.19.0.2",
+		Aliases:   []string{"gateway.docker.loc"},
+	})
+	api.Config.Labels["coredns.dockerdiscovery.host"] = "app.docker.loc"
+	daemon.Add(api)
+	daemon.Add(dockertest.NewContainer(dockertest.ContainerID(2), "detached"))
+	return daemon
+}
+
+func TestDebugRegistry(t *testing.T) {
+	dd := newTestDiscovery(t, newDebugDaemon(), "docker {\n domain docker.loc\n network_aliases backend\n ttl 60\n}")
+	startTestDiscovery(t, dd)
+
+	var reg debugRegistry
+	getDebug(t, dd, "/registry", &reg)
+	assert.True(t, reg.Ready)
+	assert.False(t, reg.Stale)
+	if assert.Len(t, reg.Containers, 2) {
+		api := reg.Containers[0]
+		assert.Equal(t, "api", api.Name)
+		assert.Equal(t, dockertest.ContainerID(1), api.ID)
+		assert.Equal(t, "172.18.0.2", api.Address.String())
+		assert.Equal(t, uint32(60), api.TTL)
+		assert.False(t, api.Updated.IsZero())
+		assert.Equal(t, "172.19.0.2", api.Networks["frontend"].IPAddress)
+		assert.Equal(t, []debugDomain{
+			{Name: "app.docker.loc", Resolvers: []string{"label coredns.dockerdiscovery.host"}, Conflicts: []string{dockertest.ContainerID(0)}},
+			{Name: "api.docker.loc", Resolvers: []string{"domain docker.loc"}},
+		}, api.Domains)
+	}
+	if assert.Len(t, reg.Skipped, 1) {
+		assert.Equal(t, "detached", reg.Skipped[0].Name)
+		assert.Contains(t, reg.Skipped[0].Skipped, "unable to find network settings")
+	}
+
+	rec := httptest.NewRecorder()
+	dd.debugHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "api.docker.loc")
+	assert.Contains(t, rec.Body.String(), "detached")
+}
+
+func TestDebugLookup(t *testing.T) {
+	dd := newTestDiscovery(t, newDebugDaemon(), "docker {\n domain docker.loc\n network_aliases backend\n}")
+	startTestDiscovery(t, dd)
+
+	var l debugLookup
+	getDebug(t, dd, "/lookup?name=app.docker.loc", &l)
+	assert.Equal(t, "app.docker.loc.", l.Name)
+	assert.Equal(t, "docker.loc.", l.Zone)
+	assert.Len(t, l.Records, 2)
+	assert.Len(t, l.Explanation, 3)
+
+	l = debugLookup{}
+	getDebug(t, dd, "/lookup?name=detached.docker.loc", &l)
+	assert.Empty(t, l.Records)
+	if assert.Len(t, l.Excluded, 1) {
+		assert.Equal(t, "detached", l.Excluded[0].Name)
+	}
+	assert.Contains(t, l.Explanation[0], "through domain docker.loc but has no record")
+
+	l = debugLookup{}
+	getDebug(t, dd, "/lookup?name=gateway.docker.loc", &l)
+	assert.Equal(t, []string{
+		"container api (" + dockertest.ContainerID(1)[:12] + ") has the alias on network frontend, which network_aliases does not publish",
+		"no container produces the name with resolvers label coredns.dockerdiscovery.host, domain docker.loc, network_aliases backend",
+	}, l.Explanation)
+
+	l = debugLookup{}
+	getDebug(t, dd, "/lookup?name=example.org", &l)
+	assert.Equal(t, "", l.Zone)
+	assert.Contains(t, l.Explanation[0], "outside the zones")
+
+	rec := httptest.NewRecorder()
+	dd.debugHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/lookup", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestDebugHTTPReload(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	config := "docker {\n domain docker.loc\n debug_http " + addr + "\n}"
+	daemon := newDebugDaemon()
+	old := newTestDiscovery(t, daemon, config)
+	startTestDiscovery(t, old)
+
+	// A reload starts the new instance before the old one is shut down.
+	assert.NoError(t, old.onRestart())
+	dd := newTestDiscovery(t, daemon, config)
+	startTestDiscovery(t, dd)
+	assert.NoError(t, old.shutdown())
+
+	resp, err := http.Get("http://" + addr + "/registry")
+	if assert.NoError(t, err) {
+		var reg debugRegistry
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&reg))
+		resp.Body.Close()
+		assert.Len(t, reg.Containers, 2)
+	}
+
+	assert.NoError(t, dd.shutdown())
+	_, err = http.Get("http://" + addr + "/registry")
+	assert.Error(t, err)
+}
+
+func TestDebugHTTPSetup(t *testing.T) {
+	dd := newTestDiscovery(t, dockertest.New(), "docker {\n debug_http 127.0.0.1:8053\n}")
+	assert.Equal(t, "127.0.0.1:8053", dd.debugHTTP)
+
+	for _, config := range []string{
+		"docker {\n debug_http\n}",
+		"docker {\n debug_http 8053\n}",
+	} {
+		_, err := createPlugin(caddy.NewTestController("dns", config))
+		assert.NotNil(t, err, config)
+	}
+}
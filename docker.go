@@ -5,30 +5,76 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"net/http"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/coredns/caddy"
 
-	"github.com/coredns/coredns/plugin/metrics"
-
 	"github.com/coredns/coredns/plugin"
 	"github.com/coredns/coredns/request"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/events"
 	"github.com/docker/docker/api/types/filters"
-	"github.com/docker/docker/client"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/go-connections/tlsconfig"
 	"github.com/miekg/dns"
 )
 
 type containerInfo struct {
-	container *types.ContainerJSON
-	address   net.IP
-	addressv6 net.IP
-	domains   []string // resolved domain
+	container  *types.ContainerJSON
+	address    net.IP
+	addressv6  net.IP
+	network    string                   // network the addresses are taken from, empty with host_ports
+	excludedV6 net.IP                   // IPv6 address on that network left out by the ipv6 scope
+	ports      []publishedPort          // with host_ports
+	domains    []string                 // resolved domain
+	scoped     map[string]scopedAddress // addresses of the domains bound to a network, by domain
+	stopped    time.Time                // when the container stopped, zero while it runs
+	updated    time.Time                // when the record was last derived from docker
+}
+
+// scopedAddress holds the addresses of a container on one of its networks.
+type scopedAddress struct {
+	Address   net.IP `json:"address,omitempty"`
+	AddressV6 net.IP `json:"address_v6,omitempty"`
+
+	network    string // not kept in snapshots, only explains missing addresses
+	excludedV6 net.IP
+}
+
+// addressesOf returns the addresses name, one of the domains of info with
+// or without the trailing dot, resolves to.
+func (info *containerInfo) addressesOf(name string) (net.IP, net.IP) {
+	if scoped, ok := info.scoped[strings.TrimSuffix(name, ".")]; ok {
+		return scoped.Address, scoped.AddressV6
+	}
+	return info.address, info.addressv6
+}
+
+// sourceOf returns the network the addresses of name, one of the domains of
+// info, are taken from and the IPv6 address the ipv6 scope left out there.
+func (info *containerInfo) sourceOf(name string) (string, net.IP) {
+	if scoped, ok := info.scoped[strings.TrimSuffix(name, ".")]; ok {
+		return scoped.network, scoped.excludedV6
+	}
+	return info.network, info.excludedV6
 }
 
 type containerInfoMap map[string]*containerInfo
 
+// skippedContainer is a running container that got no record, kept to
+// explain why a name does not resolve.
+type skippedContainer struct {
+	container *types.ContainerJSON
+	domains   []string // the container would hold with a record
+	reason    string
+	updated   time.Time
+}
+
 type containerDomainResolver interface {
 	// return domains without trailing dot
 	resolve(container *types.ContainerJSON) ([]string, error)
@@ -38,25 +84,101 @@ type containerDomainResolver interface {
 type Discovery struct {
 	Next             plugin.Handler
 	dockerEndpoint   string
+	sshKey           string // private key for ssh:// endpoints
+	sshKnownHosts    string // known_hosts file for ssh:// endpoints
+	fromEnv          bool   // endpoint from the environment of the docker CLI
+	contextName      string // endpoint from a context of the docker CLI
+	tls              *tlsconfig.Options
+	clientFromEnv    bool // the client is configured by client.FromEnv
 	resolvers        []containerDomainResolver
-	dockerClient     *client.Client
+	dockerClient     dockerAPI
 	containerInfoMap containerInfoMap
+	skipped          map[string]*skippedContainer // by container ID, guarded by mutex
+	generation       uint64                       // bumped on every change of containerInfoMap
+	mutex            sync.RWMutex
 	TTL              uint32
 	Zone             string
 	Zones            []string
 	caddy            *caddy.Controller
+	reconnect        time.Duration // zero disables reconnecting to the daemon
+	serveStale       time.Duration // how long to answer while docker is unreachable
+	staleFallthrough bool          // pass queries on instead of SERVFAIL once stale records expire
+	syncWorkers      int           // concurrent inspects while syncing the running containers
+	snapshotFile     string        // empty disables snapshots
+	snapshotInterval time.Duration
+	debugHTTP        string // empty disables the debug endpoint
+	runtime          containerRuntime
+	exports          []*exporter
+	exportDelay      time.Duration // how long changes are collected before the exports are written
+	ipv6Scope        ipv6Scope     // kinds of IPv6 addresses answered
+	preferDrivers    []string      // network drivers whose addresses beat the network mode, by preference
+	hostPorts        bool          // answer with the addresses and ports published on the docker host
+	hostAddress      net.IP        // stands for bindings to every IPv4 address of the host
+	hostAddressV6    net.IP        // stands for bindings to every IPv6 address of the host
+	onStop           stopPolicy    // what the names of stopped containers are answered with
+	stopGrace        time.Duration // how long the names of stopped containers are kept
+	sinkhole         net.IP        // answered for stopped containers with on_stop sinkhole
+	sinkholeV6       net.IP
+	static           map[string][]dns.RR // records of the record directives, by name
+	aliases          map[string]string   // container name by name of the alias directives
+	updates          *updateRegistry     // records of dynamic updates, nil disables them
+	updateAddress    string              // where dynamic updates are accepted
+	tsigKeys         map[string]tsigKey  // keys dynamic updates are signed with, by key name
+	drivers          map[string]string   // network driver by network ID, guarded by driversMutex
+	driversMutex     sync.Mutex
+
+	domainMetrics bool // count requests by registered name as well
+	metrics       *instanceMetrics
+
+	snapshotGeneration uint64 // generation last written to or loaded from snapshotFile
+	seriesMutex        sync.Mutex
+	domainSeries       map[string]map[domainSeries]struct{} // per-domain request series by name
+
+	debugMutex  sync.Mutex
+	debugServer *http.Server
+
+	updateMutex   sync.Mutex
+	updateServers []*dns.Server
+
+	ready        int32 // set atomically, 1 once synced and subscribed to events
+	staleSince   int64 // set atomically, unix nanoseconds since the records are out of sync
+	staleExpired int32 // set atomically, 1 once expiry of stale records has been logged
+
+	ctx     context.Context // cancelled on shutdown, bounds every docker API call
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup // tracks the event loop and the event queue workers
+	events  *eventQueue
+	changes chan struct{} // signalled by changed, drained by exportLoop
 }
 
 // NewDiscovery constructs a new DockerDiscovery object
-func NewDiscovery(c *caddy.Controller, dockerEndpoint string) Discovery {
-	return Discovery{
+func NewDiscovery(c *caddy.Controller, dockerEndpoint string) *Discovery {
+	ctx, cancel := context.WithCancel(context.Background())
+	dd := &Discovery{
 		dockerEndpoint:   dockerEndpoint,
 		containerInfoMap: make(containerInfoMap),
+		skipped:          make(map[string]*skippedContainer),
+		domainSeries:     make(map[string]map[domainSeries]struct{}),
+		metrics:          newInstanceMetrics(),
 		caddy:            c,
+		serveStale:       serveStaleForever,
+		syncWorkers:      defaultSyncWorkers,
+		runtime:          dockerRuntime,
+		exportDelay:      defaultExportDelay,
+		ipv6Scope:        defaultIPv6Scope,
+		onStop:           stopRemove,
+		stopGrace:        defaultStopGrace,
+		drivers:          make(map[string]string),
+		changes:          make(chan struct{}, 1),
+		ctx:              ctx,
+		cancel:           cancel,
+		staleSince:       time.Now().UnixNano(),
 	}
+	dd.events = newEventQueue(dd, eventShards)
+	return dd
 }
 
-func (dd Discovery) resolveDomainsByContainer(container *types.ContainerJSON) ([]string, error) {
+func (dd *Discovery) resolveDomainsByContainer(container *types.ContainerJSON) ([]string, error) {
 	var domains []string
 	for _, resolver := range dd.resolvers {
 		var d, err = resolver.resolve(container)
@@ -69,20 +191,90 @@ func (dd Discovery) resolveDomainsByContainer(container *types.ContainerJSON) ([
 	return domains, nil
 }
 
-func (dd Discovery) containerInfoByDomain(requestName string) (*containerInfo, error) {
-	for _, containerInfoData := range dd.containerInfoMap {
-		for _, d := range containerInfoData.domains {
-			if fmt.Sprintf("%s.", d) == requestName { // qualified domain name must be specified with a trailing dot
-				return containerInfoData, nil
+// scopedAddressesOf returns the addresses of the domains of container that
+// are bound to one of its networks, nil if there are none. With host_ports
+// every name resolves to the addresses on the docker host.
+func (dd *Discovery) scopedAddressesOf(container *types.ContainerJSON) map[string]scopedAddress {
+	if dd.hostPorts {
+		return nil
+	}
+	var scoped map[string]scopedAddress
+	for _, resolver := range dd.resolvers {
+		resolver, ok := resolver.(*networkDomainResolver)
+		if !ok {
+			continue
+		}
+		for domain, endpoint := range resolver.endpoints(container) {
+			if scoped == nil {
+				scoped = make(map[string]scopedAddress)
 			}
+			scoped[domain] = dd.addressOn(networkNameOf(container, endpoint), endpoint, nil)
 		}
 	}
+	return scoped
+}
 
+// containerInfoByDomain returns the record of the container holding
+// requestName, the first of containersByDomain. It returns nil if there is
+// none.
+func (dd *Discovery) containerInfoByDomain(requestName string) (*containerInfo, error) {
+	if infos := dd.containersByDomain(requestName); len(infos) > 0 {
+		return infos[0], nil
+	}
 	return nil, nil
 }
 
+// containersByDomain returns the records of the running containers holding
+// requestName, e.g. the replicas sharing a network alias, sorted by ID. If
+// none runs it returns the stopped container holding it.
+func (dd *Discovery) containersByDomain(requestName string) []*containerInfo {
+	dd.mutex.RLock()
+	defer dd.mutex.RUnlock()
+
+	var running []*containerInfo
+	var stopped *containerInfo // running containers win over stopped ones
+	for id, containerInfoData := range dd.containerInfoMap {
+		for _, d := range containerInfoData.domains {
+			if fmt.Sprintf("%s.", d) != requestName { // qualified domain name must be specified with a trailing dot
+				continue
+			}
+			if containerInfoData.stopped.IsZero() {
+				running = append(running, containerInfoData)
+			} else if stopped == nil || id < stopped.container.ID {
+				stopped = containerInfoData
+			}
+			break
+		}
+	}
+
+	if len(running) == 0 {
+		if stopped == nil {
+			return nil
+		}
+		return []*containerInfo{stopped}
+	}
+	sort.Slice(running, func(i, j int) bool { return running[i].container.ID < running[j].container.ID })
+	return running
+}
+
+// skippedByDomain returns a container without a record that would hold
+// requestName, nil if there is none.
+func (dd *Discovery) skippedByDomain(requestName string) *skippedContainer {
+	dd.mutex.RLock()
+	defer dd.mutex.RUnlock()
+
+	for _, skipped := range dd.skipped {
+		for _, d := range skipped.domains {
+			if fmt.Sprintf("%s.", d) == requestName {
+				return skipped
+			}
+		}
+	}
+	return nil
+}
+
 // ServeDNS implements plugin.Handler
-func (dd Discovery) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+func (dd *Discovery) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
 	state := request.Request{W: w, Req: r}
 
 	zone := plugin.Zones(dd.Zones).Matches(state.Name())
@@ -90,42 +282,62 @@ func (dd Discovery) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.M
 		return plugin.NextOrFailure(dd.Name(), dd.Next, ctx, w, r)
 	}
 
-	var answers []dns.RR
-	switch state.QType() {
-	case dns.TypeA:
-		containerInfoData, _ := dd.containerInfoByDomain(state.QName())
-		if containerInfoData != nil && containerInfoData.address != nil {
-			metricsDockerSuccessCountVec.WithLabelValues(metrics.WithServer(ctx), zone, state.QName()).Inc()
-			metricsDockerSuccessCount.Inc()
-			log.Debugf("[zone/%s] A Found ip %v for zone %s and host %s", dd.Zone, containerInfoData.address, zone, state.QName())
-			answers = dd.a(state, []net.IP{containerInfoData.address})
-		} else {
-			metricsDockerFailureCountVec.WithLabelValues(metrics.WithServer(ctx), zone, state.QName()).Inc()
-			metricsDockerFailureCount.Inc()
-		}
-	case dns.TypeAAAA:
-		containerInfoData, _ := dd.containerInfoByDomain(state.QName())
-		if containerInfoData != nil && containerInfoData.addressv6 != nil {
-			metricsDockerSuccessCountVec.WithLabelValues(metrics.WithServer(ctx), zone, state.QName()).Inc()
-			metricsDockerSuccessCount.Inc()
-			log.Debugf("[zone/%s] AAAA Found ip %v for zone %s and host %s", dd.Zone, containerInfoData.addressv6, zone, state.QName())
-			answers = dd.aaaa(state, []net.IP{containerInfoData.addressv6})
-		} else {
-			metricsDockerFailureCountVec.WithLabelValues(metrics.WithServer(ctx), zone, state.QName()).Inc()
-			metricsDockerFailureCount.Inc()
+	start := time.Now()
+	defer func() {
+		dd.metrics.observer(metricsDockerLookupDuration, zone).Observe(time.Since(start).Seconds())
+	}()
+
+	var extras []dns.RR
+	var containerInfoData *containerInfo
+	var name string // the name of a container asked for
+	// records of the Corefile and of dynamic updates do not depend on docker,
+	// they are served whether or not the registry is in sync; the addresses
+	// of aliases do
+	answers, local := dd.localRecords(state.QName(), state.QType())
+	fromDocker := !local || dd.isAlias(state.QName())
+	if fromDocker {
+		if stale, expired := dd.staleness(); expired {
+			return dd.refuseStale(ctx, w, r, zone)
+		} else if stale {
+			dd.metrics.counter(metricsDockerStaleRequests, zone, "serve").Inc()
 		}
 	}
+	if !local {
+		answers, extras, containerInfoData, name = dd.answerContainer(state, zone)
+	}
 
-	if len(answers) == 0 {
-		return plugin.NextOrFailure(dd.Name(), dd.Next, ctx, w, r)
+	stopped := containerInfoData != nil && !containerInfoData.stopped.IsZero()
+	if state.QType() == dns.TypeANY && (local || containerInfoData != nil) && !(stopped && dd.onStop == stopNXDomain) {
+		answers = []dns.RR{dd.hinfo(state.QName())}
+	} else if local {
+		answers = dd.chaseCNAME(answers, state.QType())
+	}
+	var code uint16
+	var reason string
+	if len(answers) == 0 && !stopped && !local {
+		var ok bool
+		if code, reason, ok = dd.explainNoAnswer(containerInfoData, state.QName(), name, state.QType()); !ok {
+			return plugin.NextOrFailure(dd.Name(), dd.Next, ctx, w, r)
+		}
 	}
 
 	m := new(dns.Msg)
 	m.SetReply(r)
 	m.Authoritative, m.RecursionAvailable, m.Compress = true, true, true
-	m.Answer = answers
+	m.Answer, m.Extra = answers, extras
+	if len(answers) == 0 {
+		m.Ns = []dns.RR{dd.soa(zone)}
+	}
 
 	state.SizeAndDo(m)
+	if stopped {
+		dd.explainStopped(m, containerInfoData)
+	} else if reason != "" {
+		setEDE(m, code, reason)
+	}
+	if fromDocker {
+		dd.explainStale(m)
+	}
 	m = state.Scrub(m)
 	err := w.WriteMsg(m)
 	if err != nil {
@@ -134,16 +346,151 @@ func (dd Discovery) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.M
 	return dns.RcodeSuccess, nil
 }
 
+// answerContainer returns the records of the container answering a query
+// for zone, the container and the name of it asked for.
+func (dd *Discovery) answerContainer(state request.Request, zone string) (answers, extras []dns.RR, containerInfoData *containerInfo, name string) {
+	switch qtype := state.QType(); {
+	case qtype == dns.TypeA || qtype == dns.TypeAAAA:
+		name = state.QName()
+		// every container holding the name answers, as in the embedded DNS
+		// of docker
+		var addresses, addressesv6 []net.IP
+		for _, info := range dd.containersByDomain(name) {
+			if containerInfoData == nil {
+				containerInfoData = info
+			}
+			address, addressv6 := dd.addressesFor(info, name)
+			addresses, addressesv6 = appendAddress(addresses, address), appendAddress(addressesv6, addressv6)
+		}
+		// the other family goes to the additional section, saving the client a query
+		answers, extras = dd.a(name, addresses), dd.aaaa(name, addressesv6)
+		if qtype == dns.TypeAAAA {
+			answers, extras = extras, answers
+		}
+		if len(answers) > 0 {
+			dd.countRequest(zone, name, containerInfoData, true)
+			log.Debugf("[zone/%s] %s Found ip %v for zone %s and host %s", dd.Zone, dns.TypeToString[qtype], answers[0], zone, name)
+		} else {
+			dd.countRequest(zone, name, containerInfoData, false)
+			extras = nil
+		}
+	case qtype == dns.TypeSRV && dd.hostPorts:
+		port, proto, service, ok := splitServiceName(state.QName())
+		if ok {
+			name = service
+			containerInfoData, _ = dd.containerInfoByDomain(name)
+		}
+		var address, addressv6 net.IP
+		if containerInfoData != nil {
+			address, addressv6 = dd.addressesFor(containerInfoData, name)
+		}
+		if address != nil || addressv6 != nil {
+			answers = dd.srv(state.QName(), name, containerInfoData, port, proto)
+		}
+		if len(answers) > 0 {
+			dd.countRequest(zone, name, containerInfoData, true)
+			log.Debugf("[zone/%s] SRV Found port %d/%s for zone %s and host %s", dd.Zone, port, proto, zone, name)
+			extras = append(dd.a(name, []net.IP{address}), dd.aaaa(name, []net.IP{addressv6})...)
+		} else if ok {
+			dd.countRequest(zone, name, containerInfoData, false)
+		} else {
+			dd.countRequest(zone, state.QName(), nil, false)
+		}
+	case qtype == dns.TypeHTTPS || qtype == dns.TypeSVCB:
+		name = state.QName()
+		containerInfoData, _ = dd.containerInfoByDomain(name)
+		if containerInfoData != nil {
+			answers = dd.serviceBinding(name, containerInfoData, qtype)
+		}
+		if len(answers) > 0 {
+			dd.countRequest(zone, name, containerInfoData, true)
+			log.Debugf("[zone/%s] %s Found %s for zone %s and host %s", dd.Zone, dns.TypeToString[qtype], answers[0], zone, name)
+		} else if containerInfoData == nil {
+			dd.countRequest(zone, name, nil, false)
+		}
+	default:
+		// the names of containers are answered here whatever the type, rather
+		// than passed on and possibly forwarded upstream
+		name = state.QName()
+		containerInfoData, _ = dd.containerInfoByDomain(name)
+	}
+	return answers, extras, containerInfoData, name
+}
+
+// hinfo returns the answer to ANY queries for name, which are refused as
+// RFC 8482 suggests.
+func (dd *Discovery) hinfo(name string) *dns.HINFO {
+	return &dns.HINFO{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeHINFO, Class: dns.ClassINET, Ttl: dd.TTL},
+		Cpu: "RFC8482",
+	}
+}
+
+// soa returns the SOA record of origin, whose serial is the current time.
+func (dd *Discovery) soa(origin string) *dns.SOA {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: origin, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: dd.TTL},
+		Ns:      "ns.dns." + origin,
+		Mbox:    "hostmaster." + origin,
+		Serial:  uint32(time.Now().Unix()),
+		Refresh: 7200,
+		Retry:   1800,
+		Expire:  86400,
+		Minttl:  dd.TTL,
+	}
+}
+
 // Name implements plugin.Handler
-func (dd Discovery) Name() string {
+func (dd *Discovery) Name() string {
 	return pluginName
 }
 
-func (dd Discovery) getContainerAddress(container *types.ContainerJSON) (net.IP, net.IP, error) {
+// Ready implements ready.Readiness. It reports true once the running
+// containers have been synced and the event stream is connected.
+func (dd *Discovery) Ready() bool {
+	return atomic.LoadInt32(&dd.ready) == 1
+}
+
+func (dd *Discovery) setReady(ready bool) {
+	var v int32
+	if ready {
+		v = 1
+		dd.markFresh()
+	} else {
+		dd.markStale()
+	}
+	atomic.StoreInt32(&dd.ready, v)
+}
+
+// addressOn returns the addresses of an endpoint on the named network, see
+// ipv6Of for settings.
+func (dd *Discovery) addressOn(name string, endpoint *network.EndpointSettings, settings *types.NetworkSettings) scopedAddress {
+	addressv6, excluded := dd.ipv6Of(endpoint, settings)
+	return scopedAddress{
+		Address:    net.ParseIP(endpoint.IPAddress), // ParseIP return nil when IPAddress equals ""
+		AddressV6:  addressv6,
+		network:    name,
+		excludedV6: excluded,
+	}
+}
+
+func (dd *Discovery) getContainerAddress(container *types.ContainerJSON) (scopedAddress, error) {
 	for {
+		normalizeNetworkSettings(container)
 		log.Debugf("Network settings: %#v", container.NetworkSettings)
-		if container.NetworkSettings.IPAddress != "" {
-			return net.ParseIP(container.NetworkSettings.IPAddress), net.ParseIP(container.NetworkSettings.GlobalIPv6Address), nil
+		if container.HostConfig == nil || !strings.HasPrefix(string(container.HostConfig.NetworkMode), "container:") {
+			// the pinned network or a preferred driver beat the network mode
+			endpoint, err := dd.selectEndpoint(container)
+			if err != nil {
+				return scopedAddress{}, err
+			}
+			if endpoint != nil {
+				return dd.addressOn(networkNameOf(container, endpoint), endpoint, nil), nil
+			}
+		}
+		if settings := container.NetworkSettings; settings.IPAddress != "" {
+			bridge := &network.EndpointSettings{IPAddress: settings.IPAddress, GlobalIPv6Address: settings.GlobalIPv6Address}
+			return dd.addressOn(dd.runtime.defaultNetwork, bridge, settings), nil
 		}
 
 		networkMode := container.HostConfig.NetworkMode
@@ -157,123 +504,354 @@ func (dd Discovery) getContainerAddress(container *types.ContainerJSON) (net.IP,
 		if strings.HasPrefix(string(networkMode), "container:") {
 			log.Debugf("[zone/%s] Container %s is in another container's network namspace", dd.Zone, container.ID[:12])
 			otherID := container.HostConfig.NetworkMode[len("container:"):]
-			var err error
-			*container, err = dd.dockerClient.ContainerInspect(context.TODO(), string(otherID))
+			// the addresses are the other container's, the record stays the one of container
+			other, err := dd.dockerClient.ContainerInspect(dd.ctx, string(otherID))
 			if err != nil {
-				return nil, nil, err
+				dd.countAPIError("inspect", err)
+				return scopedAddress{}, err
 			}
+			container = &other
 			continue
 		} else {
-			network, ok := container.NetworkSettings.Networks[string(networkMode)]
+			endpoint, ok := dd.endpointOf(container)
 			if !ok { // sometime while "network:disconnect" event fire
-				return nil, nil, fmt.Errorf("unable to find network settings for the network %s", networkMode)
+				return scopedAddress{}, fmt.Errorf("unable to find network settings for the network %s", networkMode)
 			}
 
-			return net.ParseIP(network.IPAddress), net.ParseIP(container.NetworkSettings.GlobalIPv6Address), nil // ParseIP return nil when IPAddress equals ""
+			return dd.addressOn(networkNameOf(container, endpoint), endpoint, nil), nil
 		}
 	}
 }
 
-func (dd Discovery) updateContainerInfo(container *types.ContainerJSON) error {
-	_, isExist := dd.containerInfoMap[container.ID]
-	containerAddress, containerv6Address, err := dd.getContainerAddress(container)
+func (dd *Discovery) updateContainerInfo(container *types.ContainerJSON) error {
+	if container.State != nil && !container.State.Running { // exited since the event or the listing
+		return dd.removeContainerInfo(container.ID)
+	}
+	var source scopedAddress
+	var ports []publishedPort
+	var err error
+	if dd.hostPorts {
+		source.Address, source.AddressV6, ports = dd.hostPortsOf(container)
+	} else {
+		source, err = dd.getContainerAddress(container)
+	}
+	containerAddress, containerv6Address := source.Address, source.AddressV6
+
+	var previous []string
+	defer func() { dd.forgetDomainMetrics(previous) }() // runs after the unlock below
+
+	dd.mutex.Lock()
+	defer dd.mutex.Unlock()
+
+	previousInfo, isExist := dd.containerInfoMap[container.ID]
 	if isExist { // remove previous resolved container info
+		previous = previousInfo.domains
 		delete(dd.containerInfoMap, container.ID)
+		dd.changed()
 	}
 
+	domains, _ := dd.resolveDomainsByContainer(container)
 	if err != nil || (containerAddress == nil && containerv6Address == nil) {
+		reason := "no address"
+		switch {
+		case err != nil:
+			reason = err.Error()
+		case source.network != "" && source.excludedV6 != nil:
+			reason = fmt.Sprintf("no address on network %s but %s, which the ipv6 scope excludes", source.network, source.excludedV6)
+		case source.network != "":
+			reason = "no address on network " + source.network
+		}
+		dd.skipped[container.ID] = &skippedContainer{container: container, domains: domains, reason: reason, updated: time.Now()}
 		log.Debugf("[zone/%s] Remove container entry %s (%s)", dd.Zone, normalizeContainerName(container), container.ID[:12])
 		return err
 	}
 
-	domains, _ := dd.resolveDomainsByContainer(container)
 	if len(domains) > 0 {
+		delete(dd.skipped, container.ID)
 		dd.containerInfoMap[container.ID] = &containerInfo{
-			container: container,
-			address:   containerAddress,
-			addressv6: containerv6Address,
-			domains:   domains,
+			container:  container,
+			address:    containerAddress,
+			addressv6:  containerv6Address,
+			network:    source.network,
+			excludedV6: source.excludedV6,
+			ports:      ports,
+			domains:    domains,
+			scoped:     dd.scopedAddressesOf(container),
+			updated:    time.Now(),
 		}
+		dd.changed()
 
 		if !isExist {
 			log.Debugf("[zone/%s] A dd entry of container %s (%s). IP: %v, IP6: %v, Domains: [%s]", dd.Zone, normalizeContainerName(container), container.ID[:12], containerAddress, containerv6Address, strings.Join(domains, ", "))
 		}
-	} else if isExist {
-		log.Debugf("[zone/%s] Remove container entry %s (%s)", dd.Zone, normalizeContainerName(container), container.ID[:12])
+	} else {
+		dd.skipped[container.ID] = &skippedContainer{container: container, reason: "no domain", updated: time.Now()}
+		if isExist {
+			log.Debugf("[zone/%s] Remove container entry %s (%s)", dd.Zone, normalizeContainerName(container), container.ID[:12])
+		}
 	}
 	return nil
 }
 
-func (dd Discovery) removeContainerInfo(containerID string) error {
+// removeContainerInfo removes the record of a container that stopped or went
+// away, or keeps it for a while with an on_stop policy.
+func (dd *Discovery) removeContainerInfo(containerID string) error {
+	if dd.onStop != stopRemove && dd.markStopped(containerID) {
+		return nil
+	}
+	dd.mutex.Lock()
+	delete(dd.skipped, containerID)
 	containerInfoData, ok := dd.containerInfoMap[containerID]
 	if !ok {
+		dd.mutex.Unlock()
 		log.Debugf("[zone/%s] No entry associated with the container %s", dd.Zone, containerID[:12])
 		return nil
 	}
 	log.Debugf("[zone/%s] Deleting entry %s (%s)", dd.Zone, normalizeContainerName(containerInfoData.container), containerInfoData.container.ID[:12])
 	delete(dd.containerInfoMap, containerID)
+	dd.changed()
+	dd.mutex.Unlock()
 
+	dd.forgetDomainMetrics(containerInfoData.domains)
 	return nil
 }
 
-func (dd Discovery) start() error {
-	log.Debugf("[zone/%s] start", dd.Zone)
-	containers, err := dd.dockerClient.ContainerList(context.Background(), types.ContainerListOptions{All: false})
+// changed records a change of the registry and wakes up the exports. The
+// caller holds the write lock.
+func (dd *Discovery) changed() {
+	dd.generation++
+	select {
+	case dd.changes <- struct{}{}:
+	default:
+	}
+}
+
+// resync records every running container and drops the records of
+// containers that are gone.
+func (dd *Discovery) resync() error {
+	containers, err := dd.dockerClient.ContainerList(dd.ctx, types.ContainerListOptions{All: false})
 	if err != nil {
+		dd.countAPIError("list", err)
 		return err
 	}
 
+	if err = dd.syncContainers(containers); err != nil {
+		return err
+	}
+
+	running := make(map[string]bool, len(containers))
 	for i := range containers {
-		container, err := dd.dockerClient.ContainerInspect(context.Background(), containers[i].ID)
-		if err != nil {
-			// TODO err
+		running[containers[i].ID] = true
+	}
+	var gone []string
+	dd.mutex.RLock()
+	for id := range dd.containerInfoMap {
+		if !running[id] {
+			gone = append(gone, id)
 		}
-		if err = dd.updateContainerInfo(&container); err != nil {
-			log.Errorf("[zone/%s] Error adding A record for container %s: %+v", dd.Zone, container.ID[:12], err)
+	}
+	for id := range dd.skipped {
+		if !running[id] {
+			gone = append(gone, id)
+		}
+	}
+	dd.mutex.RUnlock()
+	for _, id := range gone {
+		dd.removeContainerInfo(id)
+	}
+
+	metricsmetricsDockerDomainsUpdate(dd)
+	return nil
+}
+
+// startup launches the docker event loop. It is stopped by shutdown.
+func (dd *Discovery) startup() error {
+	dd.updateMetrics()
+	if err := dd.startDebugHTTP(); err != nil {
+		return err
+	}
+	if dd.updates != nil {
+		if err := dd.updates.load(); err != nil {
+			return err
+		}
+	}
+	if err := dd.startUpdates(); err != nil {
+		return err
+	}
+	if dd.snapshotFile != "" {
+		if err := dd.loadSnapshot(); err != nil {
+			log.Warningf("[zone/%s] Ignoring snapshot: %s", dd.Zone, err)
+		}
+		dd.wg.Add(1)
+		go func() {
+			defer dd.wg.Done()
+			dd.snapshotLoop()
+		}()
+	}
+
+	if len(dd.exports) > 0 {
+		dd.wg.Add(1)
+		go func() {
+			defer dd.wg.Done()
+			dd.exportLoop()
+		}()
+	}
+
+	dd.events.start()
+	dd.wg.Add(1)
+	go func() {
+		defer dd.wg.Done()
+		if err := dd.start(); err != nil {
+			log.Errorf("[zone/%s] processing finished with error: %+v", dd.Zone, err)
+		}
+	}()
+	return nil
+}
+
+// shutdown cancels the event loop, stops the debug endpoint and the update
+// listener, waits for them and the event queue workers to return and closes
+// the docker client.
+func (dd *Discovery) shutdown() error {
+	dd.cancel()
+	if err := dd.stopDebugHTTP(); err != nil {
+		log.Warningf("[zone/%s] Error stopping debug_http: %s", dd.Zone, err)
+	}
+	if err := dd.stopUpdates(); err != nil {
+		log.Warningf("[zone/%s] Error stopping the update listener: %s", dd.Zone, err)
+	}
+	dd.wg.Wait()
+	return dd.dockerClient.Close()
+}
+
+// onRestart releases what the successor started by a reload takes over:
+// the metric series and the debug_http and update addresses.
+func (dd *Discovery) onRestart() error {
+	dd.metrics.close()
+	if err := dd.stopUpdates(); err != nil {
+		return err
+	}
+	return dd.stopDebugHTTP()
+}
+
+// onRestartFailed takes back what onRestart released when the reload failed
+// and the instance keeps serving.
+func (dd *Discovery) onRestartFailed() error {
+	dd.metrics.reopen()
+	dd.updateMetrics()
+	if err := dd.startUpdates(); err != nil {
+		return err
+	}
+	return dd.startDebugHTTP()
+}
+
+// start keeps the registry in sync with the docker daemon until the
+// instance is shut down. When reconnect is configured a failed session is
+// retried after that interval, otherwise the first failure is returned.
+func (dd *Discovery) start() error {
+	for {
+		err := dd.watch()
+		// a shutdown or reload is not a failed session, the records stay fresh
+		if dd.ctx.Err() != nil {
+			atomic.StoreInt32(&dd.ready, 0)
+			log.Debugf("[zone/%s] stop", dd.Zone)
+			return nil
+		}
+		dd.setReady(false)
+		if dd.reconnect == 0 {
+			return err
+		}
+		log.Errorf("[zone/%s] docker session lost: %+v, reconnecting in %s", dd.Zone, err, dd.reconnect)
+
+		select {
+		case <-dd.ctx.Done():
+			log.Debugf("[zone/%s] stop", dd.Zone)
+			return nil
+		case <-time.After(dd.reconnect):
 		}
 	}
+}
 
-	metricsDockerContainers.WithLabelValues().Set(float64(len(dd.containerInfoMap)))
-	metricsmetricsDockerDomainsUpdate(&dd)
+// watch subscribes to docker events, resyncs the running containers and
+// then applies the events until the event stream fails. Subscribing first
+// keeps the changes made while the containers are listed. The instance is
+// ready once both are done.
+func (dd *Discovery) watch() error {
+	log.Debugf("[zone/%s] start", dd.Zone)
 
 	filter := filters.NewArgs()
 
 	filter.Add("type", "container")
 	filter.Add("event", "start")
-	filter.Add("event", "die")
+	for _, action := range dd.runtime.dieActions {
+		filter.Add("event", action)
+	}
 
 	filter.Add("type", "network")
 	filter.Add("event", "connect")
 	filter.Add("event", "disconnect")
 
-	event, errChan := dd.dockerClient.Events(context.Background(), types.EventsOptions{Filters: filter})
+	// cancelled when the session ends, the stream is not read after that
+	ctx, cancel := context.WithCancel(dd.ctx)
+	defer cancel()
+	event, errChan := dd.dockerClient.Events(ctx, types.EventsOptions{Filters: filter})
+
+	// Events returns once the stream is established or has failed; a failure
+	// is already waiting on errChan in the latter case.
+	select {
+	case err := <-errChan:
+		dd.countAPIError("events", err)
+		return err
+	default:
+	}
+
+	if err := dd.resync(); err != nil {
+		return err
+	}
+	dd.setReady(true)
 
-forLoop:
 	for {
 		select {
-		case err = <-errChan:
-			// TODO err
-			// return err
-			log.Errorf("[zone/%s] docker client event litener error acquired: %+v", dd.Zone, err)
-			break forLoop
+		case <-dd.ctx.Done():
+			return nil
+		case err := <-errChan:
+			if err == nil {
+				err = errors.New("docker event loop closed")
+			}
+			dd.countAPIError("events", err)
+			return err
 		case msg := <-event:
-			go dockerEventHandler(&dd, msg)
+			for _, msg := range dd.withNetworkDependents(normalizeEvent(msg)) {
+				if !dd.events.push(msg) {
+					return nil
+				}
+			}
 		}
 	}
+}
 
-	// for msg := range events {
-	// }
-
-	return errors.New("docker event loop closed")
+// appendAddress appends ip to ips unless it is nil or already there.
+func appendAddress(ips []net.IP, ip net.IP) []net.IP {
+	if ip == nil {
+		return ips
+	}
+	for _, known := range ips {
+		if known.Equal(ip) {
+			return ips
+		}
+	}
+	return append(ips, ip)
 }
 
-// a takes a slice of net.IPs and returns a slice of A RRs.
-func (dd Discovery) a(state request.Request, ips []net.IP) []dns.RR {
+// a takes a slice of net.IPs and returns a slice of A RRs named name.
+func (dd *Discovery) a(name string, ips []net.IP) []dns.RR {
 	var answers []dns.RR
 	for _, ip := range ips {
+		if ip == nil {
+			continue
+		}
 		answers = append(answers, &dns.A{
 			Hdr: dns.RR_Header{
-				Name:   state.QName(),
+				Name:   name,
 				Ttl:    dd.TTL,
 				Class:  dns.ClassINET,
 				Rrtype: dns.TypeA,
@@ -284,13 +862,16 @@ func (dd Discovery) a(state request.Request, ips []net.IP) []dns.RR {
 	return answers
 }
 
-// aaaa takes a slice of net.IPs and returns a slice of A RRs.
-func (dd Discovery) aaaa(state request.Request, ips []net.IP) []dns.RR {
+// aaaa takes a slice of net.IPs and returns a slice of AAAA RRs named name.
+func (dd *Discovery) aaaa(name string, ips []net.IP) []dns.RR {
 	var answers []dns.RR
 	for _, ip := range ips {
+		if ip == nil {
+			continue
+		}
 		answers = append(answers, &dns.AAAA{
 			Hdr: dns.RR_Header{
-				Name:   state.QName(),
+				Name:   name,
 				Ttl:    dd.TTL,
 				Class:  dns.ClassINET,
 				Rrtype: dns.TypeAAAA,
@@ -303,11 +884,18 @@ func (dd Discovery) aaaa(state request.Request, ips []net.IP) []dns.RR {
 
 func dockerEventHandler(dd *Discovery, msg events.Message) {
 	event := fmt.Sprintf("%s:%s", msg.Type, msg.Action)
+	dd.metrics.counter(metricsDockerEvents, event).Inc()
+	if msg.TimeNano != 0 {
+		defer func() {
+			dd.metrics.observer(metricsDockerEventLag).Observe(time.Since(time.Unix(0, msg.TimeNano)).Seconds())
+		}()
+	}
 	switch event {
 	case "container:start":
 		log.Debugf("[zone/%s] New container #%s spawned. Attempt to add A record for it", dd.Zone, msg.Actor.ID[:12])
-		container, err := dd.dockerClient.ContainerInspect(context.Background(), msg.Actor.ID)
+		container, err := dd.dockerClient.ContainerInspect(dd.ctx, msg.Actor.ID)
 		if err != nil {
+			dd.countAPIError("inspect", err)
 			log.Errorf("[zone/%s] Container #%s event %s: %s", dd.Zone, msg.Actor.ID[:12], event, err)
 			return
 		}
@@ -315,7 +903,7 @@ func dockerEventHandler(dd *Discovery, msg events.Message) {
 			log.Errorf("[zone/%s] Error adding A record for container #%s: %s", dd.Zone, container.ID[:12], err)
 		}
 	case "container:die":
-		log.Debugf("[zone/%s] Container %%s being stopped. Attempt to remove its A record from the DNS", dd.Zone, msg.Actor.ID[:12])
+		log.Debugf("[zone/%s] Container #%s being stopped. Attempt to remove its A record from the DNS", dd.Zone, msg.Actor.ID[:12])
 		if err := dd.removeContainerInfo(msg.Actor.ID); err != nil {
 			log.Errorf("[zone/%s] Error deleting A record for container: %s: %s", dd.Zone, msg.Actor.ID[:12], err)
 		}
@@ -323,8 +911,9 @@ func dockerEventHandler(dd *Discovery, msg events.Message) {
 		// take a look https://gist.github.com/josefkarasek/be9bac36921f7bc9a61df23451594fbf for example of same event's types attributes
 		log.Debugf("[zone/%s] Container #%s being connected to network %s.", dd.Zone, msg.Actor.Attributes["container"][:12], msg.Actor.Attributes["name"])
 
-		container, err := dd.dockerClient.ContainerInspect(context.Background(), msg.Actor.Attributes["container"])
+		container, err := dd.dockerClient.ContainerInspect(dd.ctx, msg.Actor.Attributes["container"])
 		if err != nil {
+			dd.countAPIError("inspect", err)
 			log.Errorf("[zone/%s] Event error %s #%s: %s", dd.Zone, event, msg.Actor.Attributes["container"][:12], err)
 			return
 		}
@@ -334,8 +923,9 @@ func dockerEventHandler(dd *Discovery, msg events.Message) {
 	case "network:disconnect":
 		log.Debugf("[zone/%s] Container %s being disconnected from network %s", dd.Zone, msg.Actor.Attributes["container"][:12], msg.Actor.Attributes["name"])
 
-		container, err := dd.dockerClient.ContainerInspect(context.Background(), msg.Actor.Attributes["container"])
+		container, err := dd.dockerClient.ContainerInspect(dd.ctx, msg.Actor.Attributes["container"])
 		if err != nil {
+			dd.countAPIError("inspect", err)
 			log.Errorf("[zone/%s] Event error %s #%s: %s", dd.Zone, event, msg.Actor.Attributes["container"][:12], err)
 			return
 		}
@@ -343,6 +933,5 @@ func dockerEventHandler(dd *Discovery, msg events.Message) {
 			log.Errorf("[zone/%s] Error adding A record for container %s: %s", dd.Zone, container.ID[:12], err)
 		}
 	}
-	metricsDockerContainers.WithLabelValues().Set(float64(len(dd.containerInfoMap)))
 	metricsmetricsDockerDomainsUpdate(dd)
 }
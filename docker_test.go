@@ -0,0 +1,205 @@
+package docker
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/rb-coredns/coredns-docker-discovery/dockertest"
+	"github.com/stretchr/testify/assert"
+)
+
+var _ dockerAPI = (*dockertest.Daemon)(nil)
+
+// newTestDiscovery creates the plugin from a Corefile block of a docker.loc.
+// server block, talking to the in-memory daemon. Queries it does not answer
+// get REFUSED from the next plugin.
+func newTestDiscovery(t testing.TB, daemon *dockertest.Daemon, config string) *Discovery {
+	c := caddy.NewTestController("dns", config)
+	dnsserver.GetConfig(c).Zone = "docker.loc."
+	dd, err := createPlugin(c)
+	if err != nil {
+		t.Fatalf("%s: %s", config, err)
+	}
+	dd.dockerClient.Close()
+	dd.dockerClient = daemon
+	dd.Next = test.NextHandler(dns.RcodeRefused, nil)
+	t.Cleanup(func() { dd.shutdown() })
+	return dd
+}
+
+// startTestDiscovery starts the plugin and waits until it is ready.
+func startTestDiscovery(t testing.TB, dd *Discovery) {
+	if err := dd.startup(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !dd.Ready() {
+		if time.Now().After(deadline) {
+			t.Fatal("plugin did not become ready")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// lookup sends a query through ServeDNS and returns the rcode and the
+// written response, nil when the plugin did not write one.
+func lookup(dd *Discovery, name string, qtype uint16) (int, *dns.Msg) {
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(name), qtype)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	rcode, _ := dd.ServeDNS(context.Background(), rec, req)
+	return rcode, rec.Msg
+}
+
+// answerIPs returns the addresses of the A and AAAA records of a response.
+func answerIPs(m *dns.Msg) []string {
+	if m == nil {
+		return nil
+	}
+	var ips []string
+	for _, rr := range m.Answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			ips = append(ips, rr.A.String())
+		case *dns.AAAA:
+			ips = append(ips, rr.AAAA.String())
+		}
+	}
+	return ips
+}
+
+// isNoData reports whether m is an empty authoritative answer.
+func isNoData(m *dns.Msg) bool {
+	return m != nil && m.Rcode == dns.RcodeSuccess && m.Authoritative && len(m.Answer) == 0 && len(m.Ns) == 1
+}
+
+func TestServeDNS(t *testing.T) {
+	daemon := dockertest.New()
+	daemon.AddNetwork("backend", "bridge")
+	web, db := dockertest.ContainerID(0), dockertest.ContainerID(1)
+	daemon.Add(dockertest.NewContainer(web, "web", dockertest.Endpoint{
+		Network:           "bridge",
+		IPAddress:         "172.17.0.2",
+		GlobalIPv6Address: "2001:db8::2",
+	}))
+
+	dd := newTestDiscovery(t, daemon, `docker {
+		domain docker.loc
+		hostname_domain host.docker.loc
+		network_aliases backend
+		ttl 60
+	}`)
+	startTestDiscovery(t, dd)
+
+	rcode, m := lookup(dd, "web.docker.loc", dns.TypeA)
+	assert.Equal(t, dns.RcodeSuccess, rcode)
+	assert.Equal(t, []string{"172.17.0.2"}, answerIPs(m))
+	assert.Equal(t, uint32(60), m.Answer[0].Header().Ttl)
+	assert.True(t, m.Authoritative)
+
+	_, m = lookup(dd, "web.host.docker.loc", dns.TypeAAAA)
+	assert.Equal(t, []string{"2001:db8::2"}, answerIPs(m))
+
+	rcode, m = lookup(dd, "missing.docker.loc", dns.TypeA)
+	assert.Equal(t, dns.RcodeRefused, rcode)
+	assert.Nil(t, m)
+
+	daemon.Start(dockertest.NewContainer(db, "db", dockertest.Endpoint{
+		Network:   "backend",
+		IPAddress: "172.18.0.2",
+		Aliases:   []string{"postgres.docker.loc"},
+	}))
+	assert.Eventually(t, func() bool {
+		_, m := lookup(dd, "postgres.docker.loc", dns.TypeA)
+		return len(answerIPs(m)) == 1
+	}, 5*time.Second, time.Millisecond)
+	_, m = lookup(dd, "db.docker.loc", dns.TypeA)
+	assert.Equal(t, []string{"172.18.0.2"}, answerIPs(m))
+
+	daemon.Stop(db)
+	assert.Eventually(t, func() bool {
+		rcode, _ := lookup(dd, "db.docker.loc", dns.TypeA)
+		return rcode == dns.RcodeRefused
+	}, 5*time.Second, time.Millisecond)
+
+	// Names of containers without an address are answered empty.
+	daemon.Disconnect(web, "bridge")
+	assert.Eventually(t, func() bool {
+		_, m := lookup(dd, "web.docker.loc", dns.TypeA)
+		return isNoData(m)
+	}, 5*time.Second, time.Millisecond)
+
+	daemon.Connect(web, dockertest.Endpoint{Network: "bridge", IPAddress: "172.17.0.5"})
+	assert.Eventually(t, func() bool {
+		_, m := lookup(dd, "web.docker.loc", dns.TypeA)
+		ips := answerIPs(m)
+		return len(ips) == 1 && net.ParseIP(ips[0]).Equal(net.ParseIP("172.17.0.5"))
+	}, 5*time.Second, time.Millisecond)
+}
+
+func TestReadiness(t *testing.T) {
+	daemon := dockertest.New()
+	dd := newTestDiscovery(t, daemon, "docker {\n reconnect 10ms\n}")
+	assert.False(t, dd.Ready())
+
+	startTestDiscovery(t, dd)
+
+	daemon.Down()
+	assert.Eventually(t, func() bool { return !dd.Ready() }, 5*time.Second, time.Millisecond)
+
+	daemon.Up()
+	assert.Eventually(t, dd.Ready, 5*time.Second, time.Millisecond)
+}
+
+func TestReconnectResyncs(t *testing.T) {
+	daemon := dockertest.New()
+	web, db := dockertest.ContainerID(0), dockertest.ContainerID(1)
+	daemon.Add(dockertest.NewContainer(web, "web", dockertest.Endpoint{Network: "bridge", IPAddress: "172.17.0.2"}))
+
+	dd := newTestDiscovery(t, daemon, "docker {\n domain docker.loc\n reconnect 10ms\n}")
+	startTestDiscovery(t, dd)
+
+	// Changes while the daemon is unreachable are picked up by the resync.
+	daemon.Down()
+	assert.Eventually(t, func() bool { return !dd.Ready() }, 5*time.Second, time.Millisecond)
+	daemon.Remove(web)
+	daemon.Add(dockertest.NewContainer(db, "db", dockertest.Endpoint{Network: "bridge", IPAddress: "172.17.0.3"}))
+	daemon.Up()
+	assert.Eventually(t, dd.Ready, 5*time.Second, time.Millisecond)
+
+	rcode, _ := lookup(dd, "web.docker.loc", dns.TypeA)
+	assert.Equal(t, dns.RcodeRefused, rcode)
+	_, m := lookup(dd, "db.docker.loc", dns.TypeA)
+	assert.Equal(t, []string{"172.17.0.3"}, answerIPs(m))
+}
+
+func TestEventsDuringResync(t *testing.T) {
+	daemon := dockertest.New()
+	web, db := dockertest.ContainerID(0), dockertest.ContainerID(1)
+	daemon.Add(dockertest.NewContainer(web, "web", dockertest.Endpoint{Network: "bridge", IPAddress: "172.17.0.2"}))
+	// db starts once the containers are listed, before the list is applied.
+	var once sync.Once
+	daemon.AfterList = func() {
+		once.Do(func() {
+			daemon.Start(dockertest.NewContainer(db, "db", dockertest.Endpoint{Network: "bridge", IPAddress: "172.17.0.3"}))
+		})
+	}
+
+	dd := newTestDiscovery(t, daemon, "docker {\n domain docker.loc\n}")
+	startTestDiscovery(t, dd)
+
+	assert.Eventually(t, func() bool {
+		_, m := lookup(dd, "db.docker.loc", dns.TypeA)
+		return len(answerIPs(m)) == 1
+	}, 5*time.Second, time.Millisecond)
+	_, m := lookup(dd, "web.docker.loc", dns.TypeA)
+	assert.Equal(t, []string{"172.17.0.2"}, answerIPs(m))
+}
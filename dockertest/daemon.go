@@ -0,0 +1,466 @@
+// Package dockertest provides an in-memory docker daemon for tests. It
+// implements the calls of the docker API client the docker plugin uses, keeps
+// containers and networks in memory and emits the events a real daemon would
+// emit when they are started, stopped, connected or disconnected.
+package dockertest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/errdefs"
+)
+
+// ErrDaemonDown is returned by every call while the daemon is down.
+var ErrDaemonDown = errors.New("Cannot connect to the Docker daemon. Is the docker daemon running?")
+
+// Daemon is an in-memory docker daemon. The zero value is not usable, use New.
+type Daemon struct {
+	// InspectLatency is added to every ContainerInspect, as a daemon under load would.
+	InspectLatency time.Duration
+	// Podman makes the daemon emit events in the layout of podman's docker
+	// compatible API: "died" when a container exits, and network events
+	// about the container with the network in the "network" attribute.
+	Podman bool
+	// AfterList, if set, is called by ContainerList once the list is taken,
+	// e.g. to start a container before the caller subscribes to events.
+	AfterList func()
+
+	mutex       sync.Mutex
+	down        bool
+	containers  map[string]*types.ContainerJSON
+	networks    map[string]types.NetworkResource
+	failures    map[string]int // inspect failures left by container ID, negative fails forever
+	inspects    int
+	subscribers map[*subscriber]struct{}
+}
+
+// eventBuffer is how many events a subscriber that is not reading is sent
+// before Emit blocks, as a daemon writes them to the stream meanwhile.
+const eventBuffer = 16
+
+type subscriber struct {
+	ctx      context.Context
+	options  types.EventsOptions
+	messages chan events.Message
+	errs     chan error
+}
+
+// New returns a running daemon with the default bridge network and no containers.
+func New() *Daemon {
+	d := &Daemon{
+		containers:  make(map[string]*types.ContainerJSON),
+		networks:    make(map[string]types.NetworkResource),
+		failures:    make(map[string]int),
+		subscribers: make(map[*subscriber]struct{}),
+	}
+	d.AddNetwork("bridge", "bridge")
+	return d
+}
+
+// Endpoint describes the attachment of a container to a network.
+type Endpoint struct {
+	Network           string
+	IPAddress         string
+	GlobalIPv6Address string
+	LinkLocalIPs      []string
+	Aliases           []string
+}
+
+// NewContainer returns the definition of a container attached to the given
+// networks, as inspected once running. The first endpoint determines the
+// network mode; an endpoint on "bridge" is also reported in the default
+// network settings, like docker does for the default bridge.
+func NewContainer(id, name string, endpoints ...Endpoint) types.ContainerJSON {
+	c := types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:         id,
+			Name:       "/" + name,
+			State:      &types.ContainerState{},
+			HostConfig: &container.HostConfig{NetworkMode: "default"},
+		},
+		Config: &container.Config{
+			Hostname: name,
+			Labels:   make(map[string]string),
+		},
+		NetworkSettings: &types.NetworkSettings{
+			Networks: make(map[string]*network.EndpointSettings),
+		},
+	}
+	for i, e := range endpoints {
+		if i == 0 && e.Network != "bridge" {
+			c.HostConfig.NetworkMode = container.NetworkMode(e.Network)
+		}
+		attach(&c, e)
+	}
+	return c
+}
+
+func attach(c *types.ContainerJSON, e Endpoint) {
+	c.NetworkSettings.Networks[e.Network] = &network.EndpointSettings{
+		NetworkID:         e.Network,
+		IPAddress:         e.IPAddress,
+		GlobalIPv6Address: e.GlobalIPv6Address,
+		Aliases:           e.Aliases,
+	}
+	if len(e.LinkLocalIPs) > 0 {
+		c.NetworkSettings.Networks[e.Network].IPAMConfig = &network.EndpointIPAMConfig{LinkLocalIPs: e.LinkLocalIPs}
+	}
+	if e.Network == "bridge" {
+		c.NetworkSettings.IPAddress = e.IPAddress
+		c.NetworkSettings.GlobalIPv6Address = e.GlobalIPv6Address
+	}
+}
+
+// ContainerID returns a valid container ID that is unique for i.
+func ContainerID(i int) string {
+	return fmt.Sprintf("%064x", i+1)
+}
+
+// AddNetwork creates a network with the given driver.
+func (d *Daemon) AddNetwork(name, driver string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.networks[name] = types.NetworkResource{Name: name, ID: name, Driver: driver, Scope: "local"}
+}
+
+// Add registers a running container without emitting an event, as if it was
+// running before anyone subscribed.
+func (d *Daemon) Add(c types.ContainerJSON) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	c.State.Running = true
+	c.State.Status = "running"
+	d.containers[c.ID] = &c
+}
+
+// Start registers a running container and emits its start event.
+func (d *Daemon) Start(c types.ContainerJSON) {
+	d.Add(c)
+	d.Emit(events.Message{
+		Type:   events.ContainerEventType,
+		Action: "start",
+		Actor:  events.Actor{ID: c.ID, Attributes: map[string]string{"name": c.Name[1:]}},
+	})
+}
+
+// Stop marks a container as exited, detaches it from its networks and
+// emits its die event.
+func (d *Daemon) Stop(id string) {
+	d.mutex.Lock()
+	c, ok := d.containers[id]
+	if ok {
+		c.State.Running = false
+		c.State.Status = "exited"
+		c.NetworkSettings.IPAddress = ""
+		c.NetworkSettings.GlobalIPv6Address = ""
+		for _, e := range c.NetworkSettings.Networks {
+			e.IPAddress = ""
+			e.GlobalIPv6Address = ""
+		}
+	}
+	d.mutex.Unlock()
+	if !ok {
+		return
+	}
+	action := "die"
+	if d.Podman {
+		action = "died"
+	}
+	d.Emit(events.Message{
+		Type:   events.ContainerEventType,
+		Action: action,
+		Actor:  events.Actor{ID: id, Attributes: map[string]string{"name": c.Name[1:], "exitCode": "0"}},
+	})
+}
+
+// Remove forgets a container without emitting an event.
+func (d *Daemon) Remove(id string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	delete(d.containers, id)
+}
+
+// Connect attaches a running container to a network and emits the
+// network's connect event.
+func (d *Daemon) Connect(id string, e Endpoint) {
+	d.mutex.Lock()
+	c, ok := d.containers[id]
+	if ok {
+		attach(c, e)
+	}
+	d.mutex.Unlock()
+	if ok {
+		d.emitNetworkEvent("connect", id, e.Network)
+	}
+}
+
+// Disconnect detaches a container from a network and emits the network's
+// disconnect event.
+func (d *Daemon) Disconnect(id, networkName string) {
+	d.mutex.Lock()
+	c, ok := d.containers[id]
+	if ok {
+		delete(c.NetworkSettings.Networks, networkName)
+		if networkName == "bridge" {
+			c.NetworkSettings.IPAddress = ""
+			c.NetworkSettings.GlobalIPv6Address = ""
+		}
+	}
+	d.mutex.Unlock()
+	if ok {
+		d.emitNetworkEvent("disconnect", id, networkName)
+	}
+}
+
+func (d *Daemon) emitNetworkEvent(action, id, networkName string) {
+	d.mutex.Lock()
+	n := d.networks[networkName]
+	name := ""
+	if c, ok := d.containers[id]; ok {
+		name = c.Name[1:]
+	}
+	d.mutex.Unlock()
+	if d.Podman {
+		d.Emit(events.Message{
+			Type:   events.NetworkEventType,
+			Action: action,
+			Actor: events.Actor{
+				ID:         id,
+				Attributes: map[string]string{"name": name, "network": networkName},
+			},
+		})
+		return
+	}
+	d.Emit(events.Message{
+		Type:   events.NetworkEventType,
+		Action: action,
+		Actor: events.Actor{
+			ID:         n.ID,
+			Attributes: map[string]string{"container": id, "name": networkName, "type": n.Driver},
+		},
+	})
+}
+
+// Emit sends an event to every subscriber whose filters match it. It blocks
+// until each of them received or buffered the event, or went away.
+func (d *Daemon) Emit(msg events.Message) {
+	now := time.Now()
+	msg.Scope = "local"
+	msg.Time = now.Unix()
+	msg.TimeNano = now.UnixNano()
+	msg.Status = msg.Action
+	msg.ID = msg.Actor.ID
+
+	d.mutex.Lock()
+	var receivers []*subscriber
+	for s := range d.subscribers {
+		if s.options.Filters.ExactMatch("type", string(msg.Type)) && s.options.Filters.ExactMatch("event", msg.Action) {
+			receivers = append(receivers, s)
+		}
+	}
+	d.mutex.Unlock()
+
+	for _, s := range receivers {
+		select {
+		case s.messages <- msg:
+		case <-s.ctx.Done():
+		}
+	}
+}
+
+// Down makes the daemon unreachable: every call fails and the open event
+// streams are closed with an error.
+func (d *Daemon) Down() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.down = true
+	for s := range d.subscribers {
+		s.errs <- ErrDaemonDown
+		close(s.errs)
+		delete(d.subscribers, s)
+	}
+}
+
+// Up makes the daemon reachable again.
+func (d *Daemon) Up() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.down = false
+}
+
+// FailInspect makes the next n inspects of a container fail, or every
+// inspect when n is negative.
+func (d *Daemon) FailInspect(id string, n int) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.failures[id] = n
+}
+
+// Inspects returns the number of ContainerInspect calls served so far.
+func (d *Daemon) Inspects() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.inspects
+}
+
+// Subscribers returns the number of open event streams.
+func (d *Daemon) Subscribers() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return len(d.subscribers)
+}
+
+// ContainerList implements the docker API client. Only options.All is honoured.
+func (d *Daemon) ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.down {
+		return nil, ErrDaemonDown
+	}
+
+	var list []types.Container
+	for id, c := range d.containers {
+		if !c.State.Running && !options.All {
+			continue
+		}
+		list = append(list, types.Container{
+			ID:      id,
+			Names:   []string{c.Name},
+			Labels:  c.Config.Labels,
+			State:   c.State.Status,
+			Created: time.Now().Unix(),
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	if d.AfterList != nil {
+		d.mutex.Unlock()
+		d.AfterList()
+		d.mutex.Lock()
+	}
+	return list, nil
+}
+
+// ContainerInspect implements the docker API client.
+func (d *Daemon) ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error) {
+	d.mutex.Lock()
+	latency := d.InspectLatency
+	d.inspects++
+	d.mutex.Unlock()
+
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-ctx.Done():
+			return types.ContainerJSON{}, ctx.Err()
+		}
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.down {
+		return types.ContainerJSON{}, ErrDaemonDown
+	}
+	if failures := d.failures[containerID]; failures != 0 {
+		if failures > 0 {
+			d.failures[containerID]--
+		}
+		return types.ContainerJSON{}, errdefs.System(errors.New("inspect failed"))
+	}
+	c, ok := d.containers[containerID]
+	if !ok {
+		return types.ContainerJSON{}, errdefs.NotFound(fmt.Errorf("No such container: %s", containerID))
+	}
+	return copyContainer(c), nil
+}
+
+// NetworkInspect implements the docker API client. Networks are found by
+// name, which is also their ID.
+func (d *Daemon) NetworkInspect(ctx context.Context, networkID string, options types.NetworkInspectOptions) (types.NetworkResource, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.down {
+		return types.NetworkResource{}, ErrDaemonDown
+	}
+	n, ok := d.networks[networkID]
+	if !ok {
+		return types.NetworkResource{}, errdefs.NotFound(fmt.Errorf("network %s not found", networkID))
+	}
+	return n, nil
+}
+
+// Events implements the docker API client. Events emitted before the call
+// are not replayed.
+func (d *Daemon) Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error) {
+	s := &subscriber{
+		ctx:      ctx,
+		options:  options,
+		messages: make(chan events.Message, eventBuffer),
+		errs:     make(chan error, 1),
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.down {
+		s.errs <- ErrDaemonDown
+		close(s.errs)
+		return s.messages, s.errs
+	}
+	d.subscribers[s] = struct{}{}
+
+	go func() {
+		<-ctx.Done()
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+		if _, ok := d.subscribers[s]; ok {
+			delete(d.subscribers, s)
+			s.errs <- ctx.Err()
+			close(s.errs)
+		}
+	}()
+	return s.messages, s.errs
+}
+
+// Close implements the docker API client.
+func (d *Daemon) Close() error {
+	return nil
+}
+
+// copyContainer returns a copy of c that shares no mutable state with it, so
+// callers may keep or modify it.
+func copyContainer(c *types.ContainerJSON) types.ContainerJSON {
+	base := *c.ContainerJSONBase
+	state := *c.State
+	hostConfig := *c.HostConfig
+	base.State = &state
+	base.HostConfig = &hostConfig
+
+	config := *c.Config
+	config.Labels = make(map[string]string, len(c.Config.Labels))
+	for k, v := range c.Config.Labels {
+		config.Labels[k] = v
+	}
+
+	settings := *c.NetworkSettings
+	settings.Networks = make(map[string]*network.EndpointSettings, len(c.NetworkSettings.Networks))
+	for name, e := range c.NetworkSettings.Networks {
+		endpoint := *e
+		endpoint.Aliases = append([]string(nil), e.Aliases...)
+		settings.Networks[name] = &endpoint
+	}
+
+	return types.ContainerJSON{
+		ContainerJSONBase: &base,
+		Config:            &config,
+		NetworkSettings:   &settings,
+		Mounts:            c.Mounts,
+	}
+}
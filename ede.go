@@ -0,0 +1,78 @@
+package docker
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// optionCodeEDE is the EDNS0 option code of Extended DNS Errors, RFC 8914.
+const optionCodeEDE = 15
+
+// Extended DNS Error codes the plugin answers with.
+const (
+	edeOther        uint16 = 0
+	edeStaleAnswer  uint16 = 3
+	edeForgedAnswer uint16 = 4
+	edeFiltered     uint16 = 17
+)
+
+// setEDE adds an Extended DNS Error to m. It is only added to responses to
+// requests with EDNS0, whose OPT record m already carries.
+func setEDE(m *dns.Msg, code uint16, text string) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return
+	}
+	data := make([]byte, 2+len(text))
+	binary.BigEndian.PutUint16(data, code)
+	copy(data[2:], text)
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: optionCodeEDE, Data: data})
+}
+
+// explainNoAnswer returns the Extended DNS Error of the empty answer to a
+// query of type qtype for qname, which asks for name, a domain of info. When
+// info is nil, the error tells why a container that would hold name has no
+// record. The text is empty for types the plugin has no records of. It
+// reports false when no container holds or would hold name, the query is
+// then passed on.
+func (dd *Discovery) explainNoAnswer(info *containerInfo, qname, name string, qtype uint16) (uint16, string, bool) {
+	if name == "" {
+		return 0, "", false
+	}
+	if info == nil {
+		skipped := dd.skippedByDomain(name)
+		if skipped == nil {
+			return 0, "", false
+		}
+		return edeOther, fmt.Sprintf("container %s has no record: %s", normalizeContainerName(skipped.container), skipped.reason), true
+	}
+
+	container := normalizeContainerName(info.container)
+	network, excluded := info.sourceOf(name)
+	family := "IPv4"
+	switch qtype {
+	case dns.TypeA:
+	case dns.TypeSRV:
+		if !dd.hostPorts {
+			return 0, "", true
+		}
+		return edeOther, fmt.Sprintf("container %s publishes no port %s", container, strings.TrimSuffix(qname, "."+name)), true
+	case dns.TypeAAAA:
+		if excluded != nil {
+			return edeFiltered, fmt.Sprintf("IPv6 address %s of container %s on network %s is excluded by the ipv6 scope", excluded, container, network), true
+		}
+		family = "IPv6"
+	default: // the plugin has no records of the type
+		return 0, "", true
+	}
+	switch {
+	case dd.hostPorts:
+		return edeOther, fmt.Sprintf("container %s publishes no port on an %s address of the host", container, family), true
+	case network != "":
+		return edeOther, fmt.Sprintf("container %s has no %s address on network %s", container, family, network), true
+	}
+	return edeOther, fmt.Sprintf("container %s has no %s address", container, family), true
+}
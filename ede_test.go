@@ -0,0 +1,77 @@
+package docker
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/rb-coredns/coredns-docker-discovery/dockertest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExplainNoAnswer(t *testing.T) {
+	daemon := dockertest.New()
+	daemon.AddNetwork("backend", "bridge")
+	daemon.AddNetwork("lan", "macvlan")
+	web, db, cache := dockertest.ContainerID(0), dockertest.ContainerID(1), dockertest.ContainerID(2)
+	daemon.Add(dockertest.NewContainer(web, "web", dockertest.Endpoint{Network: "backend", IPAddress: "172.18.0.2", LinkLocalIPs: []string{"fe80::2"}}))
+	daemon.Add(dockertest.NewContainer(db, "db", dockertest.Endpoint{Network: "backend", GlobalIPv6Address: "2001:db8::3"}))
+	c := dockertest.NewContainer(cache, "cache", dockertest.Endpoint{Network: "backend", IPAddress: "172.18.0.4"})
+	c.Config.Labels[networkLabel] = "lan"
+	daemon.Add(c)
+
+	dd := newTestDiscovery(t, daemon, "docker {\n domain docker.loc\n}")
+	startTestDiscovery(t, dd)
+
+	for _, tc := range []struct {
+		name  string
+		qtype uint16
+		ede   uint16
+		text  string
+	}{
+		{name: "db.docker.loc", qtype: dns.TypeA, ede: edeOther, text: "container db has no IPv4 address on network backend"},
+		{name: "web.docker.loc", qtype: dns.TypeAAAA, ede: edeFiltered, text: "IPv6 address fe80::2 of container web on network backend is excluded by the ipv6 scope"},
+		{name: "cache.docker.loc", qtype: dns.TypeA, ede: edeOther, text: "container cache has no record: not attached to the network lan of its " + networkLabel + " label"},
+	} {
+		rcode, m := lookupEDNS(dd, tc.name, tc.qtype)
+		assert.Equal(t, dns.RcodeSuccess, rcode, tc.name)
+		assert.True(t, isNoData(m), tc.name)
+		code, text, ok := edeOf(m)
+		assert.True(t, ok, tc.name)
+		assert.Equal(t, tc.ede, code, tc.name)
+		assert.Equal(t, tc.text, text, tc.name)
+	}
+
+	// Requests without EDNS0 get the empty answer alone.
+	_, m := lookup(dd, "db.docker.loc", dns.TypeA)
+	assert.True(t, isNoData(m))
+	assert.Nil(t, m.IsEdns0())
+
+	// Names no container would hold are passed on.
+	rcode, _ := lookupEDNS(dd, "missing.docker.loc", dns.TypeA)
+	assert.Equal(t, dns.RcodeRefused, rcode)
+}
+
+func TestExplainStale(t *testing.T) {
+	daemon := dockertest.New()
+	web := dockertest.ContainerID(0)
+	daemon.Add(dockertest.NewContainer(web, "web", dockertest.Endpoint{Network: "bridge", IPAddress: "172.17.0.2"}))
+	dd := newTestDiscovery(t, daemon, "docker {\n domain docker.loc\n record gateway.docker.loc A 172.17.0.1\n}")
+	startTestDiscovery(t, dd)
+
+	_, m := lookupEDNS(dd, "web.docker.loc", dns.TypeA)
+	_, _, ok := edeOf(m)
+	assert.False(t, ok)
+
+	dd.markStale()
+	_, m = lookupEDNS(dd, "web.docker.loc", dns.TypeA)
+	assert.Equal(t, []string{"172.17.0.2"}, answerIPs(m))
+	code, text, _ := edeOf(m)
+	assert.Equal(t, edeStaleAnswer, code)
+	assert.Contains(t, text, "docker unreachable for")
+
+	// Records of the Corefile do not depend on docker.
+	_, m = lookupEDNS(dd, "gateway.docker.loc", dns.TypeA)
+	assert.Equal(t, []string{"172.17.0.1"}, answerIPs(m))
+	_, _, ok = edeOf(m)
+	assert.False(t, ok)
+}
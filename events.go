@@ -0,0 +1,126 @@
+package docker
+
+import (
+	"hash/fnv"
+	"sync"
+
+	"github.com/docker/docker/api/types/events"
+)
+
+const (
+	eventShards      = 8
+	eventShardLength = 128 // containers with a pending event per shard before push blocks
+)
+
+// eventQueue applies docker events in order per container. Events are
+// sharded by container ID, so events of one container are always handled
+// by the same worker one after another, while different containers are
+// handled concurrently. An event arriving while an earlier event of the same
+// container is still pending replaces it: every handler derives the record
+// from the container's current state, so only the latest event matters.
+// Once a shard is full push blocks, which stalls reading the event stream.
+type eventQueue struct {
+	dd     *Discovery
+	shards []*eventShard
+
+	inflight sync.WaitGroup // pending events, see wait
+}
+
+type eventShard struct {
+	mutex   sync.Mutex
+	pending map[string]events.Message // latest unhandled event by container ID
+	queue   chan string               // container IDs with a pending event, in arrival order
+}
+
+func newEventQueue(dd *Discovery, shards int) *eventQueue {
+	q := &eventQueue{dd: dd}
+	for i := 0; i < shards; i++ {
+		q.shards = append(q.shards, &eventShard{
+			pending: make(map[string]events.Message),
+			queue:   make(chan string, eventShardLength),
+		})
+	}
+	return q
+}
+
+// eventContainerID returns the ID of the container an event is about.
+func eventContainerID(msg events.Message) string {
+	if msg.Type == events.NetworkEventType {
+		return msg.Actor.Attributes["container"]
+	}
+	return msg.Actor.ID
+}
+
+// start launches one worker per shard. Workers stop when the instance is
+// shut down.
+func (q *eventQueue) start() {
+	for _, shard := range q.shards {
+		q.dd.wg.Add(1)
+		go func(shard *eventShard) {
+			defer q.dd.wg.Done()
+			q.work(shard)
+		}(shard)
+	}
+}
+
+// push queues an event. It blocks while the container's shard is full and
+// returns false if the instance is shut down meanwhile.
+func (q *eventQueue) push(msg events.Message) bool {
+	id := eventContainerID(msg)
+	if id == "" {
+		return true
+	}
+	shard := q.shardFor(id)
+
+	shard.mutex.Lock()
+	_, coalesced := shard.pending[id]
+	shard.pending[id] = msg
+	shard.mutex.Unlock()
+	if coalesced {
+		q.dd.metrics.counter(metricsDockerEventsCoalesced).Inc()
+		return true
+	}
+
+	q.inflight.Add(1)
+	q.dd.metrics.gauge(metricsDockerEventsQueued).Inc()
+	select {
+	case shard.queue <- id:
+		return true
+	case <-q.dd.ctx.Done():
+		shard.mutex.Lock()
+		delete(shard.pending, id)
+		shard.mutex.Unlock()
+		q.dd.metrics.gauge(metricsDockerEventsQueued).Dec()
+		q.inflight.Done()
+		return false
+	}
+}
+
+func (q *eventQueue) work(shard *eventShard) {
+	for {
+		select {
+		case <-q.dd.ctx.Done():
+			return
+		case id := <-shard.queue:
+			shard.mutex.Lock()
+			msg := shard.pending[id]
+			delete(shard.pending, id)
+			shard.mutex.Unlock()
+
+			q.dd.metrics.gauge(metricsDockerEventsQueued).Dec()
+			dockerEventHandler(q.dd, msg)
+			q.inflight.Done()
+		}
+	}
+}
+
+// wait blocks until every pushed event has been handled.
+func (q *eventQueue) wait() {
+	q.inflight.Wait()
+}
+
+func (q *eventQueue) shardFor(id string) *eventShard {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return q.shards[h.Sum32()%uint32(len(q.shards))]
+}
@@ -0,0 +1,140 @@
+package docker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rb-coredns/coredns-docker-discovery/dockertest"
+	"github.com/stretchr/testify/assert"
+)
+
+func containerEvent(action, id string) events.Message {
+	return events.Message{
+		Type:   events.ContainerEventType,
+		Action: action,
+		Actor:  events.Actor{ID: id},
+	}
+}
+
+func networkEvent(action, id string) events.Message {
+	return events.Message{
+		Type:   events.NetworkEventType,
+		Action: action,
+		Actor: events.Actor{
+			ID:         "bridge",
+			Attributes: map[string]string{"container": id, "name": "bridge"},
+		},
+	}
+}
+
+type eventReplayTestCase struct {
+	events   []events.Message
+	expected bool // whether the container is resolvable after the replay
+}
+
+func TestEventReplay(t *testing.T) {
+	daemon := dockertest.New()
+	// A slow inspect lets a later die overtake an earlier start if events
+	// of a container were not handled in order.
+	daemon.InspectLatency = 20 * time.Millisecond
+	id := dockertest.ContainerID(0)
+	daemon.Add(dockertest.NewContainer(id, "web", dockertest.Endpoint{Network: "bridge", IPAddress: "172.17.0.2"}))
+
+	start, die := containerEvent("start", id), containerEvent("die", id)
+	connect, disconnect := networkEvent("connect", id), networkEvent("disconnect", id)
+
+	testCases := []eventReplayTestCase{
+		{[]events.Message{start}, true},
+		{[]events.Message{start, die}, false},
+		{[]events.Message{die, start}, true},
+		{[]events.Message{start, die, start}, true},
+		{[]events.Message{start, disconnect, die}, false},
+		{[]events.Message{connect, disconnect}, true},
+	}
+
+	for _, tc := range testCases {
+		dd := newTestDiscovery(t, daemon, "docker {\n domain docker.loc\n}")
+		dd.events.start()
+		for _, msg := range tc.events {
+			assert.True(t, dd.events.push(msg))
+		}
+		dd.events.wait()
+
+		containerInfoData, _ := dd.containerInfoByDomain("web.docker.loc.")
+		assert.Equal(t, tc.expected, containerInfoData != nil, "%v", tc.events)
+	}
+}
+
+func TestEventCoalescing(t *testing.T) {
+	daemon := dockertest.New()
+	web, db := dockertest.ContainerID(0), dockertest.ContainerID(1)
+	daemon.Add(dockertest.NewContainer(web, "web", dockertest.Endpoint{Network: "bridge", IPAddress: "172.17.0.2"}))
+	daemon.Add(dockertest.NewContainer(db, "db", dockertest.Endpoint{Network: "bridge", IPAddress: "172.17.0.3"}))
+
+	dd := newTestDiscovery(t, daemon, "docker {\n domain docker.loc\n}")
+	for _, msg := range []events.Message{
+		containerEvent("start", web),
+		networkEvent("connect", web),
+		containerEvent("start", db),
+		networkEvent("disconnect", web),
+		networkEvent("connect", web),
+	} {
+		assert.True(t, dd.events.push(msg))
+	}
+
+	dd.events.start()
+	dd.events.wait()
+
+	assert.Equal(t, 2, daemon.Inspects())
+	assert.Len(t, dd.containerInfoMap, 2)
+}
+
+func TestEventBackpressure(t *testing.T) {
+	dd := newTestDiscovery(t, dockertest.New(), "docker")
+	dd.events = newEventQueue(dd, 1)
+
+	for i := 0; i < eventShardLength; i++ {
+		assert.True(t, dd.events.push(containerEvent("die", dockertest.ContainerID(i))))
+	}
+
+	pushed := make(chan bool)
+	go func() {
+		pushed <- dd.events.push(containerEvent("die", dockertest.ContainerID(eventShardLength)))
+	}()
+
+	select {
+	case <-pushed:
+		t.Fatal("push into a full shard did not block")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	dd.events.start()
+	assert.True(t, <-pushed)
+	dd.events.wait()
+}
+
+func TestEventPushShutdown(t *testing.T) {
+	dd := newTestDiscovery(t, dockertest.New(), "docker")
+	dd.events = newEventQueue(dd, 1)
+	queued := func() float64 {
+		return testutil.ToFloat64(metricsDockerEventsQueued.WithLabelValues(instanceLabels(dd)...))
+	}
+	before := queued()
+
+	for i := 0; i < eventShardLength; i++ {
+		assert.True(t, dd.events.push(containerEvent("die", dockertest.ContainerID(i))))
+	}
+	pushed := make(chan bool)
+	go func() {
+		pushed <- dd.events.push(containerEvent("die", dockertest.ContainerID(eventShardLength)))
+	}()
+	time.Sleep(10 * time.Millisecond)
+	dd.cancel()
+
+	// The event that did not make it into the queue is not left pending.
+	assert.False(t, <-pushed)
+	assert.Equal(t, before+eventShardLength, queued())
+	assert.Len(t, dd.events.shards[0].pending, eventShardLength)
+}
@@ -0,0 +1,185 @@
+package docker
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const defaultExportDelay = time.Second
+
+// exportRetryInterval is the shortest interval the exports are retried at
+// while docker is not ready.
+const exportRetryInterval = 100 * time.Millisecond
+
+const (
+	exportHosts = "hosts"
+	exportZone  = "zone"
+)
+
+// exporter writes the registry to a file in one of the export formats.
+type exporter struct {
+	format  string // exportHosts or exportZone
+	file    string
+	origin  string // zone file origin, fully qualified
+	last    []byte // records last written, unchanged records are not written again
+	written bool
+}
+
+type exportRecord struct {
+	name string // fully qualified
+	ip   net.IP
+}
+
+// exportRecords returns the address of every name in the registry, sorted
+// by name and address.
+func (dd *Discovery) exportRecords() []exportRecord {
+	var records []exportRecord
+	dd.mutex.RLock()
+	for _, info := range dd.containerInfoMap {
+		for _, d := range info.domains {
+			address, addressv6 := dd.addressesFor(info, d)
+			for _, ip := range []net.IP{address, addressv6} {
+				if ip != nil {
+					records = append(records, exportRecord{name: dns.Fqdn(strings.ToLower(d)), ip: ip})
+				}
+			}
+		}
+	}
+	dd.mutex.RUnlock()
+
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].name != records[j].name {
+			return records[i].name < records[j].name
+		}
+		return bytes.Compare(records[i].ip.To16(), records[j].ip.To16()) < 0
+	})
+	return records
+}
+
+// hostsFile renders records in /etc/hosts format, one line per address with
+// every name it has.
+func hostsFile(records []exportRecord) []byte {
+	var order []string
+	names := make(map[string][]string)
+	for _, r := range records {
+		ip := r.ip.String()
+		if _, ok := names[ip]; !ok {
+			order = append(order, ip)
+		}
+		name := strings.TrimSuffix(r.name, ".")
+		if n := names[ip]; len(n) == 0 || n[len(n)-1] != name {
+			names[ip] = append(n, name)
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("# Generated by the coredns docker plugin, do not edit.\n")
+	for _, ip := range order {
+		fmt.Fprintf(&buf, "%s\t%s\n", ip, strings.Join(names[ip], " "))
+	}
+	return buf.Bytes()
+}
+
+// zoneRecords renders the records below origin as RFC 1035 resource records.
+func (dd *Discovery) zoneRecords(records []exportRecord, origin string) []byte {
+	var buf bytes.Buffer
+	for _, r := range records {
+		if !dns.IsSubDomain(origin, r.name) {
+			continue
+		}
+		hdr := dns.RR_Header{Name: r.name, Class: dns.ClassINET, Ttl: dd.TTL}
+		var rr dns.RR
+		if ip4 := r.ip.To4(); ip4 != nil {
+			hdr.Rrtype = dns.TypeA
+			rr = &dns.A{Hdr: hdr, A: ip4}
+		} else {
+			hdr.Rrtype = dns.TypeAAAA
+			rr = &dns.AAAA{Hdr: hdr, AAAA: r.ip}
+		}
+		buf.WriteString(rr.String())
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// zoneFile renders a zone file for origin, with an SOA whose serial is the
+// time of writing and an NS record at the apex.
+func (dd *Discovery) zoneFile(origin string, body []byte) []byte {
+	soa := dd.soa(origin)
+	apex := &dns.NS{
+		Hdr: dns.RR_Header{Name: origin, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: dd.TTL},
+		Ns:  soa.Ns,
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "; Generated by the coredns docker plugin, do not edit.\n$ORIGIN %s\n", origin)
+	buf.WriteString(soa.String() + "\n")
+	buf.WriteString(apex.String() + "\n")
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+// writeExports writes every export whose records changed since it was last
+// written.
+func (dd *Discovery) writeExports() {
+	records := dd.exportRecords()
+	for _, e := range dd.exports {
+		var body, data []byte
+		switch e.format {
+		case exportHosts:
+			body = hostsFile(records)
+			data = body
+		case exportZone:
+			body = dd.zoneRecords(records, e.origin)
+			data = dd.zoneFile(e.origin, body)
+		}
+		if e.written && bytes.Equal(e.last, body) {
+			continue
+		}
+		if err := writeFileAtomic(e.file, data, 0644); err != nil {
+			log.Errorf("[zone/%s] Error exporting %s file %s: %s", dd.Zone, e.format, e.file, err)
+			continue
+		}
+		e.last, e.written = body, true
+		log.Debugf("[zone/%s] Exported %d records to %s file %s", dd.Zone, len(records), e.format, e.file)
+	}
+}
+
+// exportLoop writes the exports once the registry is first in sync and then
+// whenever it changed, at most once per exportDelay so bursts of events
+// result in a single write. While docker is unreachable, or the sync is in
+// progress, the files keep the last complete registry.
+func (dd *Discovery) exportLoop() {
+	timer := time.NewTimer(dd.exportDelay)
+	defer timer.Stop()
+	pending := true
+
+	for {
+		select {
+		case <-dd.ctx.Done():
+			return
+		case <-dd.changes:
+			if !pending {
+				pending = true
+				timer.Reset(dd.exportDelay)
+			}
+		case <-timer.C:
+			if !dd.Ready() {
+				retry := dd.exportDelay
+				if retry < exportRetryInterval {
+					retry = exportRetryInterval
+				}
+				timer.Reset(retry)
+				continue
+			}
+			pending = false
+			dd.writeExports()
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package docker
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/miekg/dns"
+	"github.com/rb-coredns/coredns-docker-discovery/dockertest"
+	"github.com/stretchr/testify/assert"
+)
+
+func readExport(file string) string {
+	data, _ := ioutil.ReadFile(file)
+	return string(data)
+}
+
+func TestExport(t *testing.T) {
+	dir := t.TempDir()
+	hosts, zone := filepath.Join(dir, "hosts"), filepath.Join(dir, "docker.loc.db")
+
+	daemon := dockertest.New()
+	web, db := dockertest.ContainerID(0), dockertest.ContainerID(1)
+	daemon.Add(dockertest.NewContainer(web, "web", dockertest.Endpoint{
+		Network:           "bridge",
+		IPAddress:         "172.17.0.2",
+		GlobalIPv6Address: "2001:db8::2",
+	}))
+	daemon.Add(dockertest.NewContainer(db, "db", dockertest.Endpoint{Network: "bridge", IPAddress: "172.17.0.3"}))
+
+	dd := newTestDiscovery(t, daemon, `docker {
+		domain docker.loc
+		hostname_domain host.example.org
+		ttl 60
+		export hosts `+hosts+`
+		export zone `+zone+`
+		export_delay 10ms
+	}`)
+	startTestDiscovery(t, dd)
+
+	assert.Eventually(t, func() bool { return readExport(hosts) != "" && readExport(zone) != "" }, 5*time.Second, time.Millisecond)
+	assert.Equal(t, `# Generated by the coredns docker plugin, do not edit.
+172.17.0.3	db.docker.loc db.host.example.org
+172.17.0.2	web.docker.loc web.host.example.org
+2001:db8::2	web.docker.loc web.host.example.org
+`, readExport(hosts))
+	info, err := os.Stat(hosts)
+	if assert.NoError(t, err) {
+		assert.Equal(t, os.FileMode(0644), info.Mode().Perm())
+	}
+
+	// The zone file only holds the names below its origin and loads.
+	var names []string
+	zp := dns.NewZoneParser(strings.NewReader(readExport(zone)), "", zone)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		names = append(names, dns.TypeToString[rr.Header().Rrtype]+" "+rr.Header().Name)
+		assert.Equal(t, uint32(60), rr.Header().Ttl)
+	}
+	assert.NoError(t, zp.Err())
+	assert.Equal(t, []string{"SOA docker.loc.", "NS docker.loc.", "A db.docker.loc.", "A web.docker.loc.", "AAAA web.docker.loc."}, names)
+
+	daemon.Stop(db)
+	assert.Eventually(t, func() bool { return !strings.Contains(readExport(hosts), "db.docker.loc") }, 5*time.Second, time.Millisecond)
+	assert.Eventually(t, func() bool { return !strings.Contains(readExport(zone), "db.docker.loc") }, 5*time.Second, time.Millisecond)
+}
+
+func TestExportDebounce(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "hosts")
+	daemon := dockertest.New()
+	dd := newTestDiscovery(t, daemon, "docker {\n domain docker.loc\n export hosts "+file+"\n export_delay 200ms\n}")
+	startTestDiscovery(t, dd)
+	assert.Eventually(t, func() bool { return readExport(file) != "" }, 5*time.Second, time.Millisecond)
+
+	// A burst of containers is written once the export delay passed.
+	written, _ := os.Stat(file)
+	for i := 0; i < 20; i++ {
+		daemon.Start(dockertest.NewContainer(dockertest.ContainerID(i), fmt.Sprintf("web%d", i), dockertest.Endpoint{Network: "bridge", IPAddress: fmt.Sprintf("172.17.1.%d", i+1)}))
+	}
+	assert.Eventually(t, func() bool {
+		return strings.Count(readExport(file), "docker.loc") == 20
+	}, 5*time.Second, time.Millisecond)
+	info, _ := os.Stat(file)
+	assert.NotEqual(t, written.ModTime(), info.ModTime())
+
+	// Unchanged records are not written again.
+	before := []byte(readExport(file))
+	dd.mutex.Lock()
+	dd.changed()
+	dd.mutex.Unlock()
+	time.Sleep(300 * time.Millisecond)
+	after, _ := os.Stat(file)
+	assert.Equal(t, info.ModTime(), after.ModTime())
+	assert.True(t, bytes.Equal(before, []byte(readExport(file))))
+}
+
+func TestExportSetup(t *testing.T) {
+	c := caddy.NewTestController("dns", "docker {\n export hosts /tmp/hosts\n export zone /tmp/db example.org\n}")
+	dd, err := createPlugin(c)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []*exporter{
+			{format: exportHosts, file: "/tmp/hosts"},
+			{format: exportZone, file: "/tmp/db", origin: "example.org."},
+		}, dd.exports)
+		assert.Equal(t, defaultExportDelay, dd.exportDelay)
+	}
+
+	for _, config := range []string{
+		"docker {\n export hosts\n}",
+		"docker {\n export hosts /tmp/hosts example.org\n}",
+		"docker {\n export zone /tmp/db example.org extra\n}",
+		"docker {\n export json /tmp/db\n}",
+		"docker {\n export zone /tmp/db ..\n}",
+		"docker {\n export_delay soon\n}",
+		"docker {\n export_delay 0s\n}",
+	} {
+		_, err := createPlugin(caddy.NewTestController("dns", config))
+		assert.NotNil(t, err, config)
+	}
+}
@@ -0,0 +1,68 @@
+package docker
+
+import (
+	"net"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/network"
+)
+
+// ipv6Scope is a set of the kinds of IPv6 addresses answered to AAAA queries.
+type ipv6Scope uint8
+
+const (
+	ipv6Global    ipv6Scope = 1 << iota // global unicast addresses but ULAs
+	ipv6ULA                             // unique local addresses, fc00::/7
+	ipv6LinkLocal                       // link-local addresses, fe80::/10
+
+	defaultIPv6Scope = ipv6Global | ipv6ULA
+)
+
+var ipv6Scopes = map[string]ipv6Scope{
+	"global":     ipv6Global,
+	"ula":        ipv6ULA,
+	"link_local": ipv6LinkLocal,
+}
+
+// scopeOf returns the scope of ip, zero if it is no unicast IPv6 address.
+func scopeOf(ip net.IP) ipv6Scope {
+	if ip == nil || ip.To4() != nil || ip.To16() == nil {
+		return 0
+	}
+	switch {
+	case ip.IsLinkLocalUnicast():
+		return ipv6LinkLocal
+	case ip[0]&0xfe == 0xfc:
+		return ipv6ULA
+	case ip.IsGlobalUnicast():
+		return ipv6Global
+	}
+	return 0
+}
+
+// ipv6Of returns the first IPv6 address of an endpoint within the scope of
+// the instance: its global address, then its configured link-local ones.
+// settings are the network settings of the container, whose deprecated
+// top-level link-local address stands for the default bridge; nil for other
+// networks. When no address is within the scope, the first one left out is
+// returned as excluded.
+func (dd *Discovery) ipv6Of(endpoint *network.EndpointSettings, settings *types.NetworkSettings) (ip net.IP, excluded net.IP) {
+	candidates := []string{endpoint.GlobalIPv6Address}
+	if endpoint.IPAMConfig != nil {
+		candidates = append(candidates, endpoint.IPAMConfig.LinkLocalIPs...)
+	}
+	if settings != nil {
+		candidates = append(candidates, settings.LinkLocalIPv6Address)
+	}
+	for _, candidate := range candidates {
+		ip := net.ParseIP(candidate)
+		scope := scopeOf(ip)
+		if scope != 0 && dd.ipv6Scope&scope != 0 {
+			return ip, nil
+		}
+		if scope != 0 && excluded == nil {
+			excluded = ip
+		}
+	}
+	return nil, excluded
+}
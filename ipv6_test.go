@@ -0,0 +1,104 @@
+package docker
+
+import (
+	"net"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rb-coredns/coredns-docker-discovery/dockertest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIPv6PerNetwork(t *testing.T) {
+	daemon := dockertest.New()
+	daemon.AddNetwork("backend", "bridge")
+	daemon.AddNetwork("v6only", "bridge")
+	web, db, lan := dockertest.ContainerID(0), dockertest.ContainerID(1), dockertest.ContainerID(2)
+	daemon.Add(dockertest.NewContainer(web, "web",
+		dockertest.Endpoint{Network: "backend", IPAddress: "172.18.0.2", GlobalIPv6Address: "2001:db8:18::2"},
+		dockertest.Endpoint{Network: "v6only", GlobalIPv6Address: "fd00:1::3"},
+	))
+	daemon.Add(dockertest.NewContainer(db, "db", dockertest.Endpoint{Network: "v6only", GlobalIPv6Address: "fd00:1::2"}))
+	daemon.Add(dockertest.NewContainer(lan, "lan", dockertest.Endpoint{Network: "backend", IPAddress: "172.18.0.3", LinkLocalIPs: []string{"fe80::3"}}))
+
+	dd := newTestDiscovery(t, daemon, "docker {\n domain docker.loc\n domain_metrics\n}")
+	defer dd.metrics.close()
+	startTestDiscovery(t, dd)
+
+	// The IPv6 address is the one of the network the IPv4 address is taken
+	// from, user-defined networks report none in the default network settings.
+	_, m := lookup(dd, "web.docker.loc", dns.TypeA)
+	assert.Equal(t, []string{"172.18.0.2"}, answerIPs(m))
+	_, m = lookup(dd, "web.docker.loc", dns.TypeAAAA)
+	assert.Equal(t, []string{"2001:db8:18::2"}, answerIPs(m))
+
+	// Containers with an IPv6 address only get AAAA records only.
+	_, m = lookup(dd, "db.docker.loc", dns.TypeAAAA)
+	assert.Equal(t, []string{"fd00:1::2"}, answerIPs(m))
+	_, m = lookup(dd, "db.docker.loc", dns.TypeA)
+	assert.Nil(t, answerIPs(m))
+	assert.Equal(t, float64(1), testutil.ToFloat64(metricsDockerDomainRequests.WithLabelValues(instanceLabels(dd, "docker.loc.", "db.docker.loc.", "success")...)))
+	assert.Equal(t, float64(1), testutil.ToFloat64(metricsDockerDomainRequests.WithLabelValues(instanceLabels(dd, "docker.loc.", "db.docker.loc.", "no_address")...)))
+	assert.Equal(t, float64(3), testutil.ToFloat64(metricsDockerContainers.WithLabelValues(instanceLabels(dd, "docker.loc.")...)))
+
+	// Link-local addresses are not answered by default.
+	_, m = lookup(dd, "lan.docker.loc", dns.TypeAAAA)
+	assert.Nil(t, answerIPs(m))
+}
+
+func TestIPv6Scope(t *testing.T) {
+	daemon := dockertest.New()
+	daemon.AddNetwork("backend", "bridge")
+	global, ula, linkLocal := dockertest.ContainerID(0), dockertest.ContainerID(1), dockertest.ContainerID(2)
+	daemon.Add(dockertest.NewContainer(global, "global", dockertest.Endpoint{Network: "backend", IPAddress: "172.18.0.2", GlobalIPv6Address: "2001:db8::2"}))
+	daemon.Add(dockertest.NewContainer(ula, "ula", dockertest.Endpoint{Network: "backend", IPAddress: "172.18.0.3", GlobalIPv6Address: "fd00::3", LinkLocalIPs: []string{"fe80::3"}}))
+	daemon.Add(dockertest.NewContainer(linkLocal, "link-local", dockertest.Endpoint{Network: "backend", LinkLocalIPs: []string{"169.254.0.4", "fe80::4"}}))
+
+	dd := newTestDiscovery(t, daemon, "docker {\n domain docker.loc\n ipv6 global link_local\n}")
+	startTestDiscovery(t, dd)
+
+	for name, expected := range map[string][]string{
+		"global.docker.loc":     {"2001:db8::2"},
+		"ula.docker.loc":        {"fe80::3"},
+		"link-local.docker.loc": {"fe80::4"},
+	} {
+		_, m := lookup(dd, name, dns.TypeAAAA)
+		assert.Equal(t, expected, answerIPs(m), name)
+	}
+}
+
+func TestScopeOf(t *testing.T) {
+	for ip, scope := range map[string]ipv6Scope{
+		"2001:db8::1": ipv6Global,
+		"fc00::1":     ipv6ULA,
+		"fd12:3::1":   ipv6ULA,
+		"fe80::1":     ipv6LinkLocal,
+		"ff02::1":     0,
+		"::1":         0,
+		"172.17.0.2":  0,
+		"":            0,
+	} {
+		assert.Equal(t, scope, scopeOf(net.ParseIP(ip)), ip)
+	}
+}
+
+func TestIPv6Setup(t *testing.T) {
+	dd, err := createPlugin(caddy.NewTestController("dns", "docker"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, ipv6Global|ipv6ULA, dd.ipv6Scope)
+	}
+	dd, err = createPlugin(caddy.NewTestController("dns", "docker {\n ipv6 global\n}"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, ipv6Global, dd.ipv6Scope)
+	}
+
+	for _, config := range []string{
+		"docker {\n ipv6\n}",
+		"docker {\n ipv6 site_local\n}",
+	} {
+		_, err := createPlugin(caddy.NewTestController("dns", config))
+		assert.NotNil(t, err, config)
+	}
+}
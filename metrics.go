@@ -1,65 +1,436 @@
 package docker
 
 import (
+	"context"
+	"errors"
+	"sync/atomic"
+
 	"github.com/coredns/coredns/plugin"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	dto "github.com/prometheus/client_model/go"
 )
 
 var (
-	// MetricsDockerSuccessCount report the number of times we've seen a localhost.<domain> query.
+	// metricsDockerSuccessCountVec counts the requests answered with a docker record.
 	metricsDockerSuccessCountVec = promauto.NewCounterVec(prometheus.CounterOpts{
 		Namespace: plugin.Namespace,
 		Subsystem: pluginName,
 		Name:      "requests_success",
 		Help:      "Counter of success docker hosts requests.",
-	}, []string{"server", "zone", "domain"})
+	}, []string{"server", "instance", "zone"})
 
-	// metricsDockerFailureCountVec report the number of times we've seen a localhost.<domain> query.
+	// metricsDockerFailureCountVec counts the requests for one of the zones without a docker record.
 	metricsDockerFailureCountVec = promauto.NewCounterVec(prometheus.CounterOpts{
 		Namespace: plugin.Namespace,
 		Subsystem: pluginName,
 		Name:      "requests_failures",
-		Help:      "Counter of success docker hosts requests.",
-	}, []string{"server", "zone", "domain"})
+		Help:      "Counter of failure docker hosts requests, by reason.",
+	}, []string{"server", "instance", "zone", "reason"})
+
+	// metricsDockerDomainRequests counts requests by registered name, only with domain_metrics.
+	metricsDockerDomainRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "domain_requests_total",
+		Help:      "Counter of docker hosts requests for registered names, by name and result.",
+	}, []string{"server", "instance", "zone", "domain", "result"})
 
 	// metricsDockerSuccessCount report the number of times we've seen a localhost.<domain> query.
-	metricsDockerSuccessCount = promauto.NewCounter(prometheus.CounterOpts{
+	metricsDockerSuccessCount = promauto.NewCounterVec(prometheus.CounterOpts{
 		Namespace: plugin.Namespace,
 		Subsystem: pluginName,
 		Name:      "requests_success_total",
-		Help:      "Counter of failure docker hosts requests.",
-	})
+		Help:      "Counter of success docker hosts requests.",
+	}, []string{"server", "instance"})
 
 	// MetricsDockerFailureCount report the number of times we've seen a localhost.<domain> query.
-	metricsDockerFailureCount = promauto.NewCounter(prometheus.CounterOpts{
+	metricsDockerFailureCount = promauto.NewCounterVec(prometheus.CounterOpts{
 		Namespace: plugin.Namespace,
 		Subsystem: pluginName,
 		Name:      "requests_failures_total",
 		Help:      "Counter of failure docker hosts requests.",
-	})
+	}, []string{"server", "instance"})
+
+	// metricsDockerLookupDuration is the time it takes to answer a request for one of the zones.
+	metricsDockerLookupDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "lookup_duration_seconds",
+		Help:      "Histogram of the time it takes to look up a docker hosts request.",
+		Buckets:   plugin.TimeBuckets,
+	}, []string{"server", "instance", "zone"})
+
+	// metricsDockerEvents counts the handled docker events by type, e.g. "container:start".
+	metricsDockerEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "events_total",
+		Help:      "Counter of handled docker events, by event type.",
+	}, []string{"server", "instance", "event"})
 
-	// metricsDockerContainers is the combined number of docker containers entries.
+	// metricsDockerEventLag is the time between docker emitting an event and the plugin handling it.
+	metricsDockerEventLag = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "event_lag_seconds",
+		Help:      "Histogram of the time between docker emitting an event and the plugin applying it.",
+		Buckets:   plugin.TimeBuckets,
+	}, []string{"server", "instance"})
+
+	// metricsDockerAPIErrors counts failed docker API calls by call and error kind.
+	metricsDockerAPIErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "api_errors_total",
+		Help:      "Counter of failed docker API calls, by call and kind of error.",
+	}, []string{"server", "instance", "call", "kind"})
+
+	// metricsDockerContainers is the number of docker containers with a name in a zone.
 	metricsDockerContainers = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: plugin.Namespace,
 		Subsystem: pluginName,
 		Name:      "containers_count",
-		Help:      "The combined number of docker containers entries.",
-	}, []string{})
+		Help:      "The number of docker containers entries with a name in the zone.",
+	}, []string{"server", "instance", "zone"})
 
-	// metricsDockerDomains is the combined number of docker domains entries.
+	// metricsDockerDomains is the number of docker domains entries in a zone.
 	metricsDockerDomains = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: plugin.Namespace,
 		Subsystem: pluginName,
 		Name:      "domains_count",
-		Help:      "The combined number of docker domains entries.",
-	}, []string{})
+		Help:      "The number of docker domains entries in the zone.",
+	}, []string{"server", "instance", "zone"})
+
+	// metricsDockerStale is 1 while the records are no longer kept in sync with docker.
+	metricsDockerStale = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "stale",
+		Help:      "Whether the docker records are stale because docker is unreachable.",
+	}, []string{"server", "instance"})
+
+	// metricsDockerStaleRequests counts requests received while the records are stale, by action taken.
+	metricsDockerStaleRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "stale_requests_total",
+		Help:      "Counter of docker hosts requests received while the records are stale.",
+	}, []string{"server", "instance", "zone", "action"})
+
+	// metricsDockerUpdates counts the dynamic updates by response code.
+	metricsDockerUpdates = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "updates_total",
+		Help:      "Counter of dynamic updates, by response code.",
+	}, []string{"server", "instance", "zone", "rcode"})
+
+	// metricsDockerEventsQueued is the number of containers with a docker event waiting to be handled.
+	metricsDockerEventsQueued = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "events_queued",
+		Help:      "The number of containers with a docker event waiting to be handled.",
+	}, []string{"server", "instance"})
+
+	// metricsDockerEventsCoalesced counts docker events replaced by a later event of the same container.
+	metricsDockerEventsCoalesced = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "events_coalesced_total",
+		Help:      "Counter of docker events superseded by a later event of the same container before being handled.",
+	}, []string{"server", "instance"})
+
+	// metricsDockerSyncPending is the number of containers left to inspect by the running sync.
+	metricsDockerSyncPending = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "sync_pending_containers",
+		Help:      "The number of containers left to inspect by the running sync.",
+	}, []string{"server", "instance"})
+
+	// metricsDockerSyncInspects counts the container inspects of syncs by result.
+	metricsDockerSyncInspects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "sync_inspects_total",
+		Help:      "Counter of containers inspected while syncing, by result.",
+	}, []string{"server", "instance", "result"})
+
+	// metricsDockerSyncDuration is the time it takes to sync the running containers.
+	metricsDockerSyncDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "sync_duration_seconds",
+		Help:      "Histogram of the time it takes to sync the running containers.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+	}, []string{"server", "instance"})
+)
+
+// Discarded metrics are handed out by an instanceMetrics once it is closed.
+var (
+	discardedCounter  = prometheus.NewCounter(prometheus.CounterOpts{Name: "discarded"})
+	discardedGauge    = prometheus.NewGauge(prometheus.GaugeOpts{Name: "discarded"})
+	discardedObserver = prometheus.NewHistogram(prometheus.HistogramOpts{Name: "discarded"})
 )
 
+// instanceMetrics hands out the series of a plugin instance, labeled by the
+// address of its server block and by its instance name. Its series are all
+// deleted when the instance goes away on reload.
+type instanceMetrics struct {
+	server   string
+	instance string
+	closed   int32 // set atomically once the series are deleted
+}
+
+type metricVec interface {
+	prometheus.Collector
+	Delete(labels prometheus.Labels) bool
+	DeleteLabelValues(lvs ...string) bool
+}
+
+// instanceVecs are the metrics close deletes the series of an instance from.
+// Every metric labeled by server and instance must be listed.
+var instanceVecs = []metricVec{
+	metricsDockerSuccessCountVec,
+	metricsDockerFailureCountVec,
+	metricsDockerDomainRequests,
+	metricsDockerSuccessCount,
+	metricsDockerFailureCount,
+	metricsDockerLookupDuration,
+	metricsDockerEvents,
+	metricsDockerEventLag,
+	metricsDockerAPIErrors,
+	metricsDockerContainers,
+	metricsDockerDomains,
+	metricsDockerStale,
+	metricsDockerStaleRequests,
+	metricsDockerUpdates,
+	metricsDockerEventsQueued,
+	metricsDockerEventsCoalesced,
+	metricsDockerSyncPending,
+	metricsDockerSyncInspects,
+	metricsDockerSyncDuration,
+}
+
+func newInstanceMetrics() *instanceMetrics {
+	return &instanceMetrics{}
+}
+
+// labels prepends the instance labels to lvs. It returns nil once the
+// instance metrics are closed.
+func (m *instanceMetrics) labels(lvs []string) []string {
+	if atomic.LoadInt32(&m.closed) != 0 {
+		return nil
+	}
+	return append([]string{m.server, m.instance}, lvs...)
+}
+
+func (m *instanceMetrics) counter(vec *prometheus.CounterVec, lvs ...string) prometheus.Counter {
+	labels := m.labels(lvs)
+	if labels == nil {
+		return discardedCounter
+	}
+	return vec.WithLabelValues(labels...)
+}
+
+func (m *instanceMetrics) gauge(vec *prometheus.GaugeVec, lvs ...string) prometheus.Gauge {
+	labels := m.labels(lvs)
+	if labels == nil {
+		return discardedGauge
+	}
+	return vec.WithLabelValues(labels...)
+}
+
+func (m *instanceMetrics) observer(vec *prometheus.HistogramVec, lvs ...string) prometheus.Observer {
+	labels := m.labels(lvs)
+	if labels == nil {
+		return discardedObserver
+	}
+	return vec.WithLabelValues(labels...)
+}
+
+// forget deletes a single series of the instance.
+func (m *instanceMetrics) forget(vec metricVec, lvs ...string) {
+	vec.DeleteLabelValues(append([]string{m.server, m.instance}, lvs...)...)
+}
+
+// close deletes every series of the instance. Metrics handed out afterwards
+// are discarded, so an instance being replaced cannot overwrite the series
+// of its successor, which carry the same labels.
+func (m *instanceMetrics) close() error {
+	atomic.StoreInt32(&m.closed, 1)
+	for _, vec := range instanceVecs {
+		for _, labels := range m.series(vec) {
+			vec.Delete(labels)
+		}
+	}
+	return nil
+}
+
+// series returns the labels of the series of vec that belong to the
+// instance. They are collected before any is deleted, as collecting holds
+// the lock of vec.
+func (m *instanceMetrics) series(vec metricVec) []prometheus.Labels {
+	metrics := make(chan prometheus.Metric)
+	go func() {
+		vec.Collect(metrics)
+		close(metrics)
+	}()
+
+	var series []prometheus.Labels
+	for metric := range metrics {
+		var pb dto.Metric
+		if metric.Write(&pb) != nil {
+			continue
+		}
+		labels := make(prometheus.Labels, len(pb.Label))
+		for _, pair := range pb.Label {
+			labels[pair.GetName()] = pair.GetValue()
+		}
+		if labels["server"] == m.server && labels["instance"] == m.instance {
+			series = append(series, labels)
+		}
+	}
+	return series
+}
+
+// reopen undoes close.
+func (m *instanceMetrics) reopen() {
+	atomic.StoreInt32(&m.closed, 0)
+}
+
+// updateMetrics refreshes every gauge of the instance.
+func (dd *Discovery) updateMetrics() {
+	metricsmetricsDockerDomainsUpdate(dd)
+	if stale, _ := dd.staleness(); stale {
+		dd.metrics.gauge(metricsDockerStale).Set(1)
+	} else {
+		dd.metrics.gauge(metricsDockerStale).Set(0)
+	}
+}
+
 func metricsmetricsDockerDomainsUpdate(dd *Discovery) {
-	cnt := 0
+	dd.mutex.RLock()
+	defer dd.mutex.RUnlock()
+
+	containers := make(map[string]int)
+	domains := make(map[string]int)
+	for _, zone := range dd.Zones {
+		containers[zone], domains[zone] = 0, 0
+	}
 	for i := range dd.containerInfoMap {
-		cnt += len(dd.containerInfoMap[i].domains)
+		inZone := make(map[string]bool)
+		for _, d := range dd.containerInfoMap[i].domains {
+			zone := plugin.Zones(dd.Zones).Matches(d + ".")
+			if zone == "" {
+				continue
+			}
+			domains[zone]++
+			inZone[zone] = true
+		}
+		for zone := range inZone {
+			containers[zone]++
+		}
+	}
+	for zone := range domains {
+		dd.metrics.gauge(metricsDockerContainers, zone).Set(float64(containers[zone]))
+		dd.metrics.gauge(metricsDockerDomains, zone).Set(float64(domains[zone]))
+	}
+}
+
+// countRequest counts a request for name, one of the zones' names. info is
+// the record of name, if any; it is a failure when the record has no address
+// of the requested family. With domain_metrics requests for registered names
+// are also counted by name; those series are deleted by forgetDomainMetrics
+// once the name is gone, so their number stays bounded by the registry.
+func (dd *Discovery) countRequest(zone, name string, info *containerInfo, success bool) {
+	result := "success"
+	switch {
+	case success:
+		dd.metrics.counter(metricsDockerSuccessCountVec, zone).Inc()
+		dd.metrics.counter(metricsDockerSuccessCount).Inc()
+	case info == nil:
+		dd.metrics.counter(metricsDockerFailureCountVec, zone, "not_found").Inc()
+		dd.metrics.counter(metricsDockerFailureCount).Inc()
+	case !info.stopped.IsZero():
+		result = "stopped"
+		dd.metrics.counter(metricsDockerFailureCountVec, zone, result).Inc()
+		dd.metrics.counter(metricsDockerFailureCount).Inc()
+	default:
+		result = "no_address"
+		dd.metrics.counter(metricsDockerFailureCountVec, zone, result).Inc()
+		dd.metrics.counter(metricsDockerFailureCount).Inc()
+	}
+
+	if !dd.domainMetrics || info == nil {
+		return
+	}
+	dd.seriesMutex.Lock()
+	defer dd.seriesMutex.Unlock()
+	series, ok := dd.domainSeries[name]
+	if !ok {
+		series = make(map[domainSeries]struct{})
+		dd.domainSeries[name] = series
+	}
+	series[domainSeries{zone, result}] = struct{}{}
+	dd.metrics.counter(metricsDockerDomainRequests, zone, name, result).Inc()
+}
+
+// domainSeries identifies a series of metricsDockerDomainRequests for a domain.
+type domainSeries struct {
+	zone, result string
+}
+
+// forgetDomainMetrics deletes the per-domain series of domains that are no
+// longer registered.
+func (dd *Discovery) forgetDomainMetrics(domains []string) {
+	if !dd.domainMetrics {
+		return
+	}
+	for _, d := range domains {
+		name := d + "."
+		if info, _ := dd.containerInfoByDomain(name); info != nil {
+			continue
+		}
+		dd.seriesMutex.Lock()
+		for s := range dd.domainSeries[name] {
+			dd.metrics.forget(metricsDockerDomainRequests, s.zone, name, s.result)
+		}
+		delete(dd.domainSeries, name)
+		dd.seriesMutex.Unlock()
+	}
+}
+
+// countAPIError counts a failed docker API call. Calls cancelled by the
+// shutdown of the instance are not counted.
+func (dd *Discovery) countAPIError(call string, err error) {
+	if err == nil || errdefs.IsCancelled(err) || errors.Is(err, context.Canceled) {
+		return
+	}
+	dd.metrics.counter(metricsDockerAPIErrors, call, apiErrorKind(err)).Inc()
+}
+
+// apiErrorKind classifies a docker API error into a small, fixed set of kinds.
+func apiErrorKind(err error) string {
+	switch {
+	case client.IsErrConnectionFailed(err):
+		return "connection"
+	case errdefs.IsNotFound(err):
+		return "not_found"
+	case errdefs.IsUnavailable(err):
+		return "unavailable"
+	case errdefs.IsDeadline(err), errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errdefs.IsUnauthorized(err), errdefs.IsForbidden(err):
+		return "unauthorized"
+	case errdefs.IsInvalidParameter(err), errdefs.IsNotImplemented(err):
+		return "invalid"
+	case errdefs.IsSystem(err):
+		return "system"
 	}
-	metricsDockerDomains.WithLabelValues().Set(float64(cnt))
+	return "other"
 }
@@ -0,0 +1,112 @@
+package docker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rb-coredns/coredns-docker-discovery/dockertest"
+	"github.com/stretchr/testify/assert"
+)
+
+// instanceLabels prepends the instance labels of dd to lvs.
+func instanceLabels(dd *Discovery, lvs ...string) []string {
+	return append([]string{dd.metrics.server, dd.metrics.instance}, lvs...)
+}
+
+func TestDomainMetrics(t *testing.T) {
+	daemon := dockertest.New()
+	web := dockertest.ContainerID(0)
+	daemon.Add(dockertest.NewContainer(web, "web", dockertest.Endpoint{Network: "bridge", IPAddress: "172.17.0.2"}))
+
+	dd := newTestDiscovery(t, daemon, "docker {\n domain docker.loc\n}")
+	startTestDiscovery(t, dd)
+	lookup(dd, "web.docker.loc", dns.TypeA)
+	lookup(dd, "typo.docker.loc", dns.TypeA)
+	assert.Equal(t, 0, testutil.CollectAndCount(metricsDockerDomainRequests))
+	dd.shutdown()
+	dd.metrics.close()
+
+	dd = newTestDiscovery(t, daemon, "docker {\n domain docker.loc\n domain_metrics\n}")
+	startTestDiscovery(t, dd)
+	assert.Equal(t, float64(1), testutil.ToFloat64(metricsDockerContainers.WithLabelValues(instanceLabels(dd, "docker.loc.")...)))
+	assert.Equal(t, float64(1), testutil.ToFloat64(metricsDockerDomains.WithLabelValues(instanceLabels(dd, "docker.loc.")...)))
+
+	lookup(dd, "web.docker.loc", dns.TypeA)
+	lookup(dd, "web.docker.loc", dns.TypeA)
+	lookup(dd, "web.docker.loc", dns.TypeAAAA)
+	for i := 0; i < 10; i++ {
+		lookup(dd, "typo.docker.loc", dns.TypeA)
+	}
+	// Only the registered name got series, one per result.
+	assert.Equal(t, 2, testutil.CollectAndCount(metricsDockerDomainRequests))
+	assert.Equal(t, float64(2), testutil.ToFloat64(metricsDockerDomainRequests.WithLabelValues(instanceLabels(dd, "docker.loc.", "web.docker.loc.", "success")...)))
+	assert.Equal(t, float64(1), testutil.ToFloat64(metricsDockerDomainRequests.WithLabelValues(instanceLabels(dd, "docker.loc.", "web.docker.loc.", "no_address")...)))
+
+	daemon.Stop(web)
+	assert.Eventually(t, func() bool {
+		return testutil.CollectAndCount(metricsDockerDomainRequests) == 0
+	}, 5*time.Second, time.Millisecond)
+	assert.Equal(t, float64(0), testutil.ToFloat64(metricsDockerContainers.WithLabelValues(instanceLabels(dd, "docker.loc.")...)))
+	assert.Equal(t, float64(0), testutil.ToFloat64(metricsDockerDomains.WithLabelValues(instanceLabels(dd, "docker.loc.")...)))
+}
+
+func TestFailureReasons(t *testing.T) {
+	daemon := dockertest.New()
+	daemon.Add(dockertest.NewContainer(dockertest.ContainerID(0), "web", dockertest.Endpoint{Network: "bridge", IPAddress: "172.17.0.2"}))
+	dd := newTestDiscovery(t, daemon, "docker {\n domain docker.loc\n instance reasons\n}")
+	startTestDiscovery(t, dd)
+
+	lookup(dd, "web.docker.loc", dns.TypeAAAA)
+	lookup(dd, "typo.docker.loc", dns.TypeA)
+	lookup(dd, "typo.docker.loc", dns.TypeAAAA)
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(metricsDockerFailureCountVec.WithLabelValues(instanceLabels(dd, "docker.loc.", "no_address")...)))
+	assert.Equal(t, float64(2), testutil.ToFloat64(metricsDockerFailureCountVec.WithLabelValues(instanceLabels(dd, "docker.loc.", "not_found")...)))
+	assert.Equal(t, float64(3), testutil.ToFloat64(metricsDockerFailureCount.WithLabelValues(instanceLabels(dd)...)))
+}
+
+func TestInstanceMetrics(t *testing.T) {
+	first, second := dockertest.New(), dockertest.New()
+	first.Add(dockertest.NewContainer(dockertest.ContainerID(0), "web", dockertest.Endpoint{Network: "bridge", IPAddress: "172.17.0.2"}))
+
+	one := newTestDiscovery(t, first, "docker {\n domain docker.loc\n instance one\n}")
+	two := newTestDiscovery(t, second, "docker {\n domain docker.loc\n instance two\n}")
+	startTestDiscovery(t, one)
+	startTestDiscovery(t, two)
+
+	// Both instances serve the same zone without overwriting each other.
+	assert.Equal(t, float64(1), testutil.ToFloat64(metricsDockerContainers.WithLabelValues(instanceLabels(one, "docker.loc.")...)))
+	assert.Equal(t, float64(0), testutil.ToFloat64(metricsDockerContainers.WithLabelValues(instanceLabels(two, "docker.loc.")...)))
+
+	// On reload every series of the instance is dropped, and the instance
+	// can no longer recreate them while it shuts down.
+	assert.Nil(t, one.metrics.close())
+	one.shutdown()
+	for _, vec := range []metricVec{metricsDockerContainers, metricsDockerDomains, metricsDockerStale} {
+		assert.False(t, vec.DeleteLabelValues(instanceLabels(one, "docker.loc.")...))
+	}
+	assert.False(t, metricsDockerStale.DeleteLabelValues(instanceLabels(one)...))
+	for _, vec := range instanceVecs {
+		assert.Empty(t, one.metrics.series(vec))
+	}
+	assert.True(t, metricsDockerStale.DeleteLabelValues(instanceLabels(two)...))
+}
+
+func TestEventMetrics(t *testing.T) {
+	daemon := dockertest.New()
+	dd := newTestDiscovery(t, daemon, "docker {\n domain docker.loc\n instance events\n}")
+	startTestDiscovery(t, dd)
+
+	web := dockertest.ContainerID(0)
+	daemon.FailInspect(web, 1)
+	daemon.Start(dockertest.NewContainer(web, "web", dockertest.Endpoint{Network: "bridge", IPAddress: "172.17.0.2"}))
+
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(metricsDockerEvents.WithLabelValues(instanceLabels(dd, "container:start")...)) == 1
+	}, 5*time.Second, time.Millisecond)
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(metricsDockerAPIErrors.WithLabelValues(instanceLabels(dd, "inspect", "system")...)) == 1
+	}, 5*time.Second, time.Millisecond)
+}
@@ -0,0 +1,92 @@
+package docker
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/errdefs"
+)
+
+// networkLabel pins the network whose addresses a container is published with.
+const networkLabel = "coredns.dockerdiscovery.network"
+
+// selectEndpoint returns the endpoint of container its addresses are taken
+// from when that is not up to its network mode: the one on the network
+// pinned by networkLabel, or else the one on a network with a preferred
+// driver. It returns nil when neither applies.
+func (dd *Discovery) selectEndpoint(container *types.ContainerJSON) (*network.EndpointSettings, error) {
+	if container.Config != nil {
+		if name := container.Config.Labels[networkLabel]; name != "" {
+			endpoint, ok := container.NetworkSettings.Networks[name]
+			if !ok {
+				return nil, fmt.Errorf("not attached to the network %s of its %s label", name, networkLabel)
+			}
+			return endpoint, nil
+		}
+	}
+	if len(dd.preferDrivers) == 0 {
+		return nil, nil
+	}
+
+	names := make([]string, 0, len(container.NetworkSettings.Networks))
+	drivers := make(map[string]string, len(container.NetworkSettings.Networks))
+	for name, endpoint := range container.NetworkSettings.Networks {
+		driver, err := dd.networkDriver(name, endpoint)
+		if errdefs.IsNotFound(err) { // removed since the container was inspected
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+		drivers[name] = driver
+	}
+	sort.Strings(names)
+	for _, driver := range dd.preferDrivers {
+		for _, name := range names {
+			if drivers[name] == driver {
+				return container.NetworkSettings.Networks[name], nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// networkNameOf returns the name of the network endpoint, one of the
+// endpoints of container, is attached to.
+func networkNameOf(container *types.ContainerJSON, endpoint *network.EndpointSettings) string {
+	for name, e := range container.NetworkSettings.Networks {
+		if e == endpoint {
+			return name
+		}
+	}
+	return ""
+}
+
+// networkDriver returns the driver of the network an endpoint is attached
+// to. Drivers are cached by network ID, which a network keeps for its
+// lifetime.
+func (dd *Discovery) networkDriver(name string, endpoint *network.EndpointSettings) (string, error) {
+	id := endpoint.NetworkID
+	if id == "" {
+		id = name
+	}
+	dd.driversMutex.Lock()
+	driver, ok := dd.drivers[id]
+	dd.driversMutex.Unlock()
+	if ok {
+		return driver, nil
+	}
+
+	resource, err := dd.dockerClient.NetworkInspect(dd.ctx, id, types.NetworkInspectOptions{})
+	if err != nil {
+		dd.countAPIError("network_inspect", err)
+		return "", err
+	}
+	dd.driversMutex.Lock()
+	dd.drivers[id] = resource.Driver
+	dd.driversMutex.Unlock()
+	return resource.Driver, nil
+}
@@ -0,0 +1,185 @@
+package docker
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/miekg/dns"
+	"github.com/rb-coredns/coredns-docker-discovery/dockertest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPreferDriver(t *testing.T) {
+	daemon := dockertest.New()
+	daemon.AddNetwork("backend", "bridge")
+	daemon.AddNetwork("lan", "macvlan")
+	daemon.AddNetwork("wan", "ipvlan")
+	web, db, proxy := dockertest.ContainerID(0), dockertest.ContainerID(1), dockertest.ContainerID(2)
+	daemon.Add(dockertest.NewContainer(web, "web",
+		dockertest.Endpoint{Network: "backend", IPAddress: "172.18.0.2"},
+		dockertest.Endpoint{Network: "wan", IPAddress: "10.0.0.2"},
+		dockertest.Endpoint{Network: "lan", IPAddress: "192.168.1.2", GlobalIPv6Address: "2001:db8:1::2"},
+	))
+	daemon.Add(dockertest.NewContainer(db, "db", dockertest.Endpoint{Network: "backend", IPAddress: "172.18.0.3"}))
+	daemon.Add(dockertest.NewContainer(proxy, "proxy",
+		dockertest.Endpoint{Network: "bridge", IPAddress: "172.17.0.4"},
+		dockertest.Endpoint{Network: "wan", IPAddress: "10.0.0.4"},
+	))
+
+	dd := newTestDiscovery(t, daemon, "docker {\n domain docker.loc\n prefer_driver macvlan ipvlan\n}")
+	startTestDiscovery(t, dd)
+
+	for name, expected := range map[string]string{
+		"web.docker.loc":   "192.168.1.2",
+		"db.docker.loc":    "172.18.0.3",
+		"proxy.docker.loc": "10.0.0.4",
+	} {
+		_, m := lookup(dd, name, dns.TypeA)
+		assert.Equal(t, []string{expected}, answerIPs(m), name)
+	}
+	_, m := lookup(dd, "web.docker.loc", dns.TypeAAAA)
+	assert.Equal(t, []string{"2001:db8:1::2"}, answerIPs(m))
+
+	daemon.Connect(db, dockertest.Endpoint{Network: "lan", IPAddress: "192.168.1.3"})
+	assert.Eventually(t, func() bool {
+		_, m := lookup(dd, "db.docker.loc", dns.TypeA)
+		return len(answerIPs(m)) == 1 && answerIPs(m)[0] == "192.168.1.3"
+	}, 5*time.Second, time.Millisecond)
+}
+
+func TestNetworkLabel(t *testing.T) {
+	daemon := dockertest.New()
+	daemon.AddNetwork("backend", "bridge")
+	daemon.AddNetwork("lan", "macvlan")
+	web, db := dockertest.ContainerID(0), dockertest.ContainerID(1)
+	c := dockertest.NewContainer(web, "web",
+		dockertest.Endpoint{Network: "lan", IPAddress: "192.168.1.2"},
+		dockertest.Endpoint{Network: "backend", IPAddress: "172.18.0.2"},
+	)
+	c.Config.Labels[networkLabel] = "backend"
+	daemon.Add(c)
+	c = dockertest.NewContainer(db, "db", dockertest.Endpoint{Network: "backend", IPAddress: "172.18.0.3"})
+	c.Config.Labels[networkLabel] = "lan"
+	daemon.Add(c)
+
+	dd := newTestDiscovery(t, daemon, "docker {\n domain docker.loc\n prefer_driver macvlan\n}")
+	startTestDiscovery(t, dd)
+
+	// The label beats the preferred drivers.
+	_, m := lookup(dd, "web.docker.loc", dns.TypeA)
+	assert.Equal(t, []string{"172.18.0.2"}, answerIPs(m))
+
+	// Containers not attached to their pinned network have no addresses.
+	_, m = lookup(dd, "db.docker.loc", dns.TypeA)
+	assert.True(t, isNoData(m))
+
+	daemon.Connect(db, dockertest.Endpoint{Network: "lan", IPAddress: "192.168.1.3"})
+	assert.Eventually(t, func() bool {
+		_, m := lookup(dd, "db.docker.loc", dns.TypeA)
+		return len(answerIPs(m)) == 1 && answerIPs(m)[0] == "192.168.1.3"
+	}, 5*time.Second, time.Millisecond)
+}
+
+func TestPreferDriverSetup(t *testing.T) {
+	dd, err := createPlugin(caddy.NewTestController("dns", "docker {\n prefer_driver macvlan ipvlan\n}"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"macvlan", "ipvlan"}, dd.preferDrivers)
+	}
+	_, err = createPlugin(caddy.NewTestController("dns", "docker {\n prefer_driver\n}"))
+	assert.NotNil(t, err)
+}
+
+func TestNetworkDomain(t *testing.T) {
+	daemon := dockertest.New()
+	daemon.AddNetwork("project_a", "bridge")
+	daemon.AddNetwork("project_b", "bridge")
+	dbA, dbB, web := dockertest.ContainerID(0), dockertest.ContainerID(1), dockertest.ContainerID(2)
+	dbA = "aaaaaaaaaaaa" + dbA[12:] // test IDs share their short ID
+	daemon.Add(dockertest.NewContainer(dbA, "a-db-1", dockertest.Endpoint{Network: "project_a", IPAddress: "172.18.0.2", Aliases: []string{"db", "aaaa", dbA[:12]}}))
+	daemon.Add(dockertest.NewContainer(dbB, "b-db-1", dockertest.Endpoint{Network: "project_b", IPAddress: "172.19.0.2", GlobalIPv6Address: "2001:db8:19::2", Aliases: []string{"db"}}))
+	daemon.Add(dockertest.NewContainer(web, "web",
+		dockertest.Endpoint{Network: "bridge", IPAddress: "172.17.0.3"},
+		dockertest.Endpoint{Network: "project_a", IPAddress: "172.18.0.3"},
+		dockertest.Endpoint{Network: "project_b", IPAddress: "172.19.0.3"},
+	))
+
+	dd := newTestDiscovery(t, daemon, "docker {\n domain docker.loc\n network_domain net.docker.loc\n}")
+	startTestDiscovery(t, dd)
+
+	for name, expected := range map[string]string{
+		"db.project_a.net.docker.loc":          "172.18.0.2",
+		"a-db-1.project_a.net.docker.loc":      "172.18.0.2",
+		dbA[:12] + ".project_a.net.docker.loc": "172.18.0.2",
+		"aaaa.project_a.net.docker.loc":        "172.18.0.2", // an alias prefixing the ID
+		"db.project_b.net.docker.loc":          "172.19.0.2",
+		"web.project_a.net.docker.loc":         "172.18.0.3",
+		"web.project_b.net.docker.loc":         "172.19.0.3",
+		"web.docker.loc":                       "172.17.0.3",
+	} {
+		_, m := lookup(dd, name, dns.TypeA)
+		assert.Equal(t, []string{expected}, answerIPs(m), name)
+	}
+	_, m := lookup(dd, "db.project_b.net.docker.loc", dns.TypeAAAA)
+	assert.Equal(t, []string{"2001:db8:19::2"}, answerIPs(m))
+
+	// The default bridge has no embedded DNS.
+	rcode, _ := lookup(dd, "web.bridge.net.docker.loc", dns.TypeA)
+	assert.Equal(t, dns.RcodeRefused, rcode)
+
+	daemon.Disconnect(web, "project_b")
+	assert.Eventually(t, func() bool {
+		rcode, _ := lookup(dd, "web.project_b.net.docker.loc", dns.TypeA)
+		return rcode == dns.RcodeRefused
+	}, 5*time.Second, time.Millisecond)
+	_, m = lookup(dd, "web.project_a.net.docker.loc", dns.TypeA)
+	assert.Equal(t, []string{"172.18.0.3"}, answerIPs(m))
+
+	records := dd.exportRecords()
+	assert.Contains(t, records, exportRecord{name: "db.project_b.net.docker.loc.", ip: net.ParseIP("172.19.0.2")})
+}
+
+func TestNetworkDomainReplicas(t *testing.T) {
+	daemon := dockertest.New()
+	daemon.AddNetwork("project_a", "bridge")
+	web1, web2 := dockertest.ContainerID(0), dockertest.ContainerID(1)
+	daemon.Add(dockertest.NewContainer(web2, "a-web-2", dockertest.Endpoint{Network: "project_a", IPAddress: "172.18.0.3", Aliases: []string{"web"}}))
+	daemon.Add(dockertest.NewContainer(web1, "a-web-1", dockertest.Endpoint{Network: "project_a", IPAddress: "172.18.0.2", Aliases: []string{"web"}}))
+
+	dd := newTestDiscovery(t, daemon, "docker {\n network_domain docker.loc\n}")
+	startTestDiscovery(t, dd)
+
+	// Every replica answers, in the order of their IDs.
+	for i := 0; i < 10; i++ {
+		_, m := lookup(dd, "web.project_a.docker.loc", dns.TypeA)
+		assert.Equal(t, []string{"172.18.0.2", "172.18.0.3"}, answerIPs(m))
+	}
+
+	daemon.Stop(web1)
+	assert.Eventually(t, func() bool {
+		_, m := lookup(dd, "web.project_a.docker.loc", dns.TypeA)
+		return len(answerIPs(m)) == 1 && answerIPs(m)[0] == "172.18.0.3"
+	}, 5*time.Second, time.Millisecond)
+}
+
+func TestNetworkDomainNetworks(t *testing.T) {
+	daemon := dockertest.New()
+	daemon.AddNetwork("project_a", "bridge")
+	web := dockertest.ContainerID(0)
+	daemon.Add(dockertest.NewContainer(web, "web",
+		dockertest.Endpoint{Network: "bridge", IPAddress: "172.17.0.3"},
+		dockertest.Endpoint{Network: "project_a", IPAddress: "172.18.0.3"},
+	))
+
+	dd := newTestDiscovery(t, daemon, "docker {\n network_domain docker.loc bridge\n}")
+	startTestDiscovery(t, dd)
+
+	_, m := lookup(dd, "web.bridge.docker.loc", dns.TypeA)
+	assert.Equal(t, []string{"172.17.0.3"}, answerIPs(m))
+	rcode, _ := lookup(dd, "web.project_a.docker.loc", dns.TypeA)
+	assert.Equal(t, dns.RcodeRefused, rcode)
+
+	_, err := createPlugin(caddy.NewTestController("dns", "docker {\n network_domain\n}"))
+	assert.NotNil(t, err)
+}
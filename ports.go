@@ -0,0 +1,109 @@
+package docker
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/go-connections/nat"
+	"github.com/miekg/dns"
+)
+
+// publishedPort is a port of a container published on the docker host.
+type publishedPort struct {
+	Proto    string `json:"proto"`
+	Port     uint16 `json:"port"` // the port of the container
+	HostPort uint16 `json:"host_port"`
+}
+
+// hostPortsOf returns the addresses of the docker host the ports of
+// container are published on, and those ports, for host_ports. Bindings to
+// every address of the host stand for the configured host addresses.
+func (dd *Discovery) hostPortsOf(container *types.ContainerJSON) (net.IP, net.IP, []publishedPort) {
+	if container.NetworkSettings == nil {
+		return nil, nil, nil
+	}
+	keys := make([]string, 0, len(container.NetworkSettings.Ports))
+	for port := range container.NetworkSettings.Ports {
+		keys = append(keys, string(port))
+	}
+	sort.Strings(keys)
+
+	var address, addressv6 net.IP
+	var ports []publishedPort
+	seen := make(map[publishedPort]bool)
+	for _, key := range keys {
+		port := nat.Port(key)
+		for _, binding := range container.NetworkSettings.Ports[port] {
+			hostPort, err := strconv.ParseUint(binding.HostPort, 10, 16)
+			if err != nil || hostPort == 0 {
+				continue
+			}
+			published := publishedPort{Proto: port.Proto(), Port: uint16(port.Int()), HostPort: uint16(hostPort)}
+			if !seen[published] {
+				seen[published] = true
+				ports = append(ports, published)
+			}
+
+			var candidates []net.IP
+			switch ip := net.ParseIP(binding.HostIP); {
+			case binding.HostIP == "":
+				candidates = []net.IP{dd.hostAddress, dd.hostAddressV6}
+			case ip == nil:
+			case ip.IsUnspecified() && ip.To4() != nil:
+				candidates = []net.IP{dd.hostAddress}
+			case ip.IsUnspecified():
+				candidates = []net.IP{dd.hostAddressV6}
+			default:
+				candidates = []net.IP{ip}
+			}
+			for _, candidate := range candidates {
+				switch {
+				case candidate == nil:
+				case candidate.To4() != nil && address == nil:
+					address = candidate
+				case candidate.To4() == nil && addressv6 == nil:
+					addressv6 = candidate
+				}
+			}
+		}
+	}
+	return address, addressv6, ports
+}
+
+// splitServiceName splits an SRV query name of the form _PORT._PROTO.NAME.
+func splitServiceName(qname string) (port uint16, proto, name string, ok bool) {
+	labels := dns.SplitDomainName(qname)
+	if len(labels) < 3 || !strings.HasPrefix(labels[0], "_") || !strings.HasPrefix(labels[1], "_") {
+		return 0, "", "", false
+	}
+	n, err := strconv.ParseUint(labels[0][1:], 10, 16)
+	if err != nil {
+		return 0, "", "", false
+	}
+	return uint16(n), strings.ToLower(labels[1][1:]), dns.Fqdn(strings.Join(labels[2:], ".")), true
+}
+
+// srv returns the SRV records of the host ports port/proto of a container
+// is published on, with target as their target.
+func (dd *Discovery) srv(qname, target string, info *containerInfo, port uint16, proto string) []dns.RR {
+	var answers []dns.RR
+	for _, published := range info.ports {
+		if published.Port != port || published.Proto != proto {
+			continue
+		}
+		answers = append(answers, &dns.SRV{
+			Hdr: dns.RR_Header{
+				Name:   qname,
+				Ttl:    dd.TTL,
+				Class:  dns.ClassINET,
+				Rrtype: dns.TypeSRV,
+			},
+			Port:   published.HostPort,
+			Target: target,
+		})
+	}
+	return answers
+}
@@ -0,0 +1,89 @@
+package docker
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/docker/go-connections/nat"
+	"github.com/miekg/dns"
+	"github.com/rb-coredns/coredns-docker-discovery/dockertest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHostPorts(t *testing.T) {
+	daemon := dockertest.New()
+	web, api, db := dockertest.ContainerID(0), dockertest.ContainerID(1), dockertest.ContainerID(2)
+	c := dockertest.NewContainer(web, "web", dockertest.Endpoint{Network: "bridge", IPAddress: "172.17.0.2"})
+	c.NetworkSettings.Ports = nat.PortMap{
+		"80/tcp":   {{HostIP: "0.0.0.0", HostPort: "8080"}, {HostIP: "::", HostPort: "8080"}},
+		"443/tcp":  {{HostIP: "0.0.0.0", HostPort: "8443"}, {HostIP: "0.0.0.0", HostPort: "9443"}},
+		"53/udp":   {{HostIP: "", HostPort: "5353"}},
+		"9000/tcp": nil, // exposed but not published
+	}
+	daemon.Add(c)
+	c = dockertest.NewContainer(api, "api", dockertest.Endpoint{Network: "bridge", IPAddress: "172.17.0.3"})
+	c.NetworkSettings.Ports = nat.PortMap{"80/tcp": {{HostIP: "192.168.1.6", HostPort: "8081"}}}
+	daemon.Add(c)
+	daemon.Add(dockertest.NewContainer(db, "db", dockertest.Endpoint{Network: "bridge", IPAddress: "172.17.0.4"}))
+
+	dd := newTestDiscovery(t, daemon, "docker {\n domain docker.loc\n host_ports 192.168.1.5 2001:db8::5\n}")
+	startTestDiscovery(t, dd)
+
+	_, m := lookup(dd, "web.docker.loc", dns.TypeA)
+	assert.Equal(t, []string{"192.168.1.5"}, answerIPs(m))
+	_, m = lookup(dd, "web.docker.loc", dns.TypeAAAA)
+	assert.Equal(t, []string{"2001:db8::5"}, answerIPs(m))
+	_, m = lookup(dd, "api.docker.loc", dns.TypeA)
+	assert.Equal(t, []string{"192.168.1.6"}, answerIPs(m))
+	_, m = lookup(dd, "db.docker.loc", dns.TypeA)
+	assert.True(t, isNoData(m))
+	_, m = lookup(dd, "api.docker.loc", dns.TypeAAAA)
+	assert.True(t, isNoData(m))
+
+	for qname, expected := range map[string][]uint16{
+		"_80._tcp.web.docker.loc":  {8080},
+		"_443._tcp.web.docker.loc": {8443, 9443},
+		"_53._udp.web.docker.loc":  {5353},
+		"_80._tcp.api.docker.loc":  {8081},
+	} {
+		_, m := lookup(dd, qname, dns.TypeSRV)
+		if !assert.NotNil(t, m, qname) {
+			continue
+		}
+		var ports []uint16
+		for _, rr := range m.Answer {
+			srv := rr.(*dns.SRV)
+			assert.Equal(t, dns.Fqdn(strings.SplitN(qname, ".", 3)[2]), srv.Target)
+			ports = append(ports, srv.Port)
+		}
+		assert.ElementsMatch(t, expected, ports, qname)
+	}
+
+	_, m = lookup(dd, "_80._tcp.web.docker.loc", dns.TypeSRV)
+	assert.Equal(t, []string{"192.168.1.5", "2001:db8::5"}, answerIPs(&dns.Msg{Answer: m.Extra}))
+
+	for _, qname := range []string{"_9000._tcp.web.docker.loc", "_80._udp.web.docker.loc", "_80._tcp.db.docker.loc"} {
+		_, m := lookup(dd, qname, dns.TypeSRV)
+		assert.True(t, isNoData(m), qname)
+	}
+	rcode, _ := lookup(dd, "web.docker.loc", dns.TypeSRV)
+	assert.Equal(t, dns.RcodeRefused, rcode)
+}
+
+func TestHostPortsSetup(t *testing.T) {
+	dd, err := createPlugin(caddy.NewTestController("dns", "docker {\n host_ports\n}"))
+	if assert.NoError(t, err) {
+		assert.True(t, dd.hostPorts)
+		assert.Nil(t, dd.hostAddress)
+	}
+
+	for _, config := range []string{
+		"docker {\n host_ports 192.168.1.5 192.168.1.6\n}",
+		"docker {\n host_ports 0.0.0.0\n}",
+		"docker {\n host_ports docker-host\n}",
+	} {
+		_, err := createPlugin(caddy.NewTestController("dns", config))
+		assert.NotNil(t, err, config)
+	}
+}
@@ -0,0 +1,47 @@
+package docker
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/rb-coredns/coredns-docker-discovery/dockertest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryTypes(t *testing.T) {
+	daemon := dockertest.New()
+	web := dockertest.ContainerID(0)
+	daemon.Add(dockertest.NewContainer(web, "web", dockertest.Endpoint{Network: "bridge", IPAddress: "172.17.0.2", GlobalIPv6Address: "2001:db8::2"}))
+	dd := newTestDiscovery(t, daemon, "docker {\n domain docker.loc\n record gateway.docker.loc A 172.17.0.1\n}")
+	startTestDiscovery(t, dd)
+
+	// The other family is in the additional section.
+	_, m := lookup(dd, "web.docker.loc", dns.TypeA)
+	assert.Equal(t, []string{"172.17.0.2"}, answerIPs(m))
+	assert.Equal(t, []string{"2001:db8::2"}, answerIPs(&dns.Msg{Answer: m.Extra}))
+	_, m = lookup(dd, "web.docker.loc", dns.TypeAAAA)
+	assert.Equal(t, []string{"2001:db8::2"}, answerIPs(m))
+	assert.Equal(t, []string{"172.17.0.2"}, answerIPs(&dns.Msg{Answer: m.Extra}))
+
+	// ANY is answered as RFC 8482 suggests.
+	for _, name := range []string{"web.docker.loc", "gateway.docker.loc"} {
+		_, m = lookup(dd, name, dns.TypeANY)
+		if assert.Len(t, m.Answer, 1, name) {
+			assert.Equal(t, "RFC8482", m.Answer[0].(*dns.HINFO).Cpu)
+		}
+	}
+
+	// Other types of known names are answered empty, without passing them on.
+	for _, qtype := range []uint16{dns.TypeMX, dns.TypeTXT, dns.TypeCAA, dns.TypeSRV, dns.TypeHTTPS} {
+		rcode, m := lookupEDNS(dd, "web.docker.loc", qtype)
+		assert.Equal(t, dns.RcodeSuccess, rcode, dns.TypeToString[qtype])
+		assert.True(t, isNoData(m), dns.TypeToString[qtype])
+		_, _, ok := edeOf(m)
+		assert.False(t, ok, dns.TypeToString[qtype])
+	}
+
+	rcode, _ := lookup(dd, "missing.docker.loc", dns.TypeANY)
+	assert.Equal(t, dns.RcodeRefused, rcode)
+	rcode, _ = lookup(dd, "missing.docker.loc", dns.TypeMX)
+	assert.Equal(t, dns.RcodeRefused, rcode)
+}
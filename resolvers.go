@@ -2,9 +2,11 @@ package docker
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/network"
 )
 
 func normalizeContainerName(container *types.ContainerJSON) string {
@@ -23,6 +25,11 @@ func (resolver subDomainContainerNameResolver) resolve(container *types.Containe
 	return domains, nil
 }
 
+// String describes the resolver by its Corefile directive.
+func (resolver subDomainContainerNameResolver) String() string {
+	return "domain " + resolver.domain
+}
+
 type subDomainHostResolver struct {
 	domain string
 }
@@ -33,6 +40,11 @@ func (resolver subDomainHostResolver) resolve(container *types.ContainerJSON) ([
 	return domains, nil
 }
 
+// String describes the resolver by its Corefile directive.
+func (resolver subDomainHostResolver) String() string {
+	return "hostname_domain " + resolver.domain
+}
+
 type labelResolver struct {
 	hostLabel string
 }
@@ -50,6 +62,11 @@ func (resolver labelResolver) resolve(container *types.ContainerJSON) ([]string,
 	return domains, nil
 }
 
+// String describes the resolver by its Corefile directive.
+func (resolver labelResolver) String() string {
+	return "label " + resolver.hostLabel
+}
+
 type networkAliasesResolver struct {
 	network string
 }
@@ -57,16 +74,94 @@ type networkAliasesResolver struct {
 func (resolver networkAliasesResolver) resolve(container *types.ContainerJSON) ([]string, error) {
 	var domains []string
 
-	if resolver.network != "" {
-		network, ok := container.NetworkSettings.Networks[resolver.network]
-		if ok {
-			domains = append(domains, network.Aliases...)
+	for name, network := range container.NetworkSettings.Networks {
+		if resolver.network != "" && name != resolver.network {
+			continue
 		}
-	} else {
-		for _, network := range container.NetworkSettings.Networks {
-			domains = append(domains, network.Aliases...)
+		domains = append(domains, endpointAliases(container, network)...)
+	}
+
+	return domains, nil
+}
+
+// endpointAliases returns the aliases of container on a network without its
+// short ID, which daemons before API 1.44 add to them.
+func endpointAliases(container *types.ContainerJSON, endpoint *network.EndpointSettings) []string {
+	var aliases []string
+	for _, alias := range endpoint.Aliases {
+		if len(alias) == 12 && len(container.ID) >= 12 && alias == container.ID[:12] {
+			continue
 		}
+		aliases = append(aliases, alias)
 	}
+	return aliases
+}
+
+// String describes the resolver by its Corefile directive.
+func (resolver networkAliasesResolver) String() string {
+	return "network_aliases " + resolver.network
+}
+
+// networkDomainResolver publishes the names a container has in the embedded
+// DNS of docker on each user-defined network it is attached to, its name,
+// short ID and aliases, qualified by the network: NAME.NETWORK.DOMAIN. They
+// resolve to the addresses of the container on that network.
+type networkDomainResolver struct {
+	domain   string
+	networks []string // empty for every user-defined network
+	runtime  *containerRuntime
+}
 
+func (resolver networkDomainResolver) resolve(container *types.ContainerJSON) ([]string, error) {
+	var domains []string
+	for domain := range resolver.endpoints(container) {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
 	return domains, nil
 }
+
+// endpoints returns the endpoint each domain of container is bound to.
+func (resolver networkDomainResolver) endpoints(container *types.ContainerJSON) map[string]*network.EndpointSettings {
+	endpoints := make(map[string]*network.EndpointSettings)
+	if container.NetworkSettings == nil {
+		return endpoints
+	}
+	for name, endpoint := range container.NetworkSettings.Networks {
+		if !resolver.publishes(name) {
+			continue
+		}
+		names := []string{normalizeContainerName(container)}
+		if len(container.ID) >= 12 {
+			names = append(names, container.ID[:12])
+		}
+		names = append(names, endpointAliases(container, endpoint)...)
+		for _, n := range names {
+			endpoints[fmt.Sprintf("%s.%s.%s", n, name, resolver.domain)] = endpoint
+		}
+	}
+	return endpoints
+}
+
+// publishes reports whether the names on the network are published. The
+// default networks have no embedded DNS.
+func (resolver networkDomainResolver) publishes(name string) bool {
+	if len(resolver.networks) > 0 {
+		for _, n := range resolver.networks {
+			if n == name {
+				return true
+			}
+		}
+		return false
+	}
+	switch name {
+	case "bridge", "host", "none", resolver.runtime.defaultNetwork:
+		return false
+	}
+	return true
+}
+
+// String describes the resolver by its Corefile directive.
+func (resolver networkDomainResolver) String() string {
+	return strings.TrimSpace("network_domain " + resolver.domain + " " + strings.Join(resolver.networks, " "))
+}
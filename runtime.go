@@ -0,0 +1,148 @@
+package docker
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/network"
+)
+
+// containerRuntime describes how a runtime serving the docker API differs
+// from docker.
+type containerRuntime struct {
+	name           string
+	defaultNetwork string   // network of the containers in the "bridge" network mode
+	dieActions     []string // actions of the event emitted when a container exits
+}
+
+var (
+	dockerRuntime = containerRuntime{name: "docker", defaultNetwork: "bridge", dieActions: []string{"die"}}
+	podmanRuntime = containerRuntime{name: "podman", defaultNetwork: "podman", dieActions: []string{"die", "died"}}
+)
+
+var runtimes = map[string]containerRuntime{
+	dockerRuntime.name: dockerRuntime,
+	podmanRuntime.name: podmanRuntime,
+}
+
+// podmanDefaultHost returns the socket of the podman service of the current
+// user: the rootless one unless running as root.
+func podmanDefaultHost() string {
+	if uid := os.Getuid(); uid != 0 {
+		return fmt.Sprintf("unix:///run/user/%d/podman/podman.sock", uid)
+	}
+	return "unix:///run/podman/podman.sock"
+}
+
+// normalizeEvent rewrites the events of docker compatible runtimes to the
+// layout of docker's. Podman reports "died" rather than "die" on older
+// versions, and network events about the container, with the network in the
+// "network" attribute, rather than about the network, with the container in
+// the "container" attribute.
+func normalizeEvent(msg events.Message) events.Message {
+	switch msg.Type {
+	case events.ContainerEventType:
+		if msg.Action == "died" {
+			msg.Action = "die"
+		}
+	case events.NetworkEventType:
+		networkName := msg.Actor.Attributes["network"]
+		if msg.Actor.Attributes["container"] != "" || networkName == "" {
+			break
+		}
+		attributes := make(map[string]string, len(msg.Actor.Attributes)+1)
+		for k, v := range msg.Actor.Attributes {
+			attributes[k] = v
+		}
+		attributes["container"] = msg.Actor.ID
+		attributes["name"] = networkName
+		msg.Actor = events.Actor{ID: networkName, Attributes: attributes}
+	}
+	return msg
+}
+
+// endpointOf returns the settings of the network a container is reachable
+// on: the one of its network mode. Podman reports the "bridge" network mode
+// for containers on any of its networks, so in that mode the runtime's
+// default network, or else the only network of the container, is taken.
+func (dd *Discovery) endpointOf(container *types.ContainerJSON) (*network.EndpointSettings, bool) {
+	networkMode := string(container.HostConfig.NetworkMode)
+	if endpoint, ok := container.NetworkSettings.Networks[networkMode]; ok {
+		return endpoint, true
+	}
+	if networkMode != "bridge" && networkMode != "default" {
+		return nil, false
+	}
+	if endpoint, ok := container.NetworkSettings.Networks[dd.runtime.defaultNetwork]; ok {
+		return endpoint, true
+	}
+	if len(container.NetworkSettings.Networks) == 1 {
+		for _, endpoint := range container.NetworkSettings.Networks {
+			return endpoint, true
+		}
+	}
+	return nil, false
+}
+
+// joinsNetworkOf reports whether container runs in the network namespace of
+// the container with the given ID and name, e.g. as a member of the podman
+// pod whose infra container that is.
+func joinsNetworkOf(container *types.ContainerJSON, id, name string) bool {
+	if container.HostConfig == nil {
+		return false
+	}
+	networkMode := string(container.HostConfig.NetworkMode)
+	if !strings.HasPrefix(networkMode, "container:") {
+		return false
+	}
+	ref := networkMode[len("container:"):]
+	return ref != "" && (strings.HasPrefix(id, ref) || ref == name)
+}
+
+// withNetworkDependents returns msg followed, for a network event, by a copy
+// of it for every known container running in the network namespace of the
+// container it is about. Their addresses change along with that container's,
+// but docker and podman only emit the event for the container owning the
+// namespace.
+func (dd *Discovery) withNetworkDependents(msg events.Message) []events.Message {
+	msgs := []events.Message{msg}
+	id := eventContainerID(msg)
+	if msg.Type != events.NetworkEventType || id == "" {
+		return msgs
+	}
+
+	dd.mutex.RLock()
+	defer dd.mutex.RUnlock()
+
+	var name string
+	if info, ok := dd.containerInfoMap[id]; ok {
+		name = normalizeContainerName(info.container)
+	} else if skipped, ok := dd.skipped[id]; ok {
+		name = normalizeContainerName(skipped.container)
+	}
+
+	dependent := func(dependentID string) {
+		attributes := make(map[string]string, len(msg.Actor.Attributes))
+		for k, v := range msg.Actor.Attributes {
+			attributes[k] = v
+		}
+		attributes["container"] = dependentID
+		dependentMsg := msg
+		dependentMsg.Actor = events.Actor{ID: msg.Actor.ID, Attributes: attributes}
+		msgs = append(msgs, dependentMsg)
+	}
+	for dependentID, info := range dd.containerInfoMap {
+		if dependentID != id && joinsNetworkOf(info.container, id, name) {
+			dependent(dependentID)
+		}
+	}
+	for dependentID, skipped := range dd.skipped {
+		if dependentID != id && joinsNetworkOf(skipped.container, id, name) {
+			dependent(dependentID)
+		}
+	}
+	return msgs
+}
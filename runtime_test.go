@@ -0,0 +1,116 @@
+package docker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/miekg/dns"
+	"github.com/rb-coredns/coredns-docker-discovery/dockertest"
+	"github.com/stretchr/testify/assert"
+)
+
+// podmanContainer returns a container as podman reports it: in the "bridge"
+// network mode whatever networks it is attached to.
+func podmanContainer(id, name string, endpoints ...dockertest.Endpoint) types.ContainerJSON {
+	c := dockertest.NewContainer(id, name, endpoints...)
+	c.HostConfig.NetworkMode = "bridge"
+	return c
+}
+
+func TestPodman(t *testing.T) {
+	daemon := dockertest.New()
+	daemon.Podman = true
+	daemon.AddNetwork("podman", "bridge")
+	daemon.AddNetwork("lan", "macvlan")
+	web, infra, app := dockertest.ContainerID(0), dockertest.ContainerID(1), dockertest.ContainerID(2)
+	daemon.Add(podmanContainer(web, "web", dockertest.Endpoint{Network: "podman", IPAddress: "10.88.0.2"}))
+
+	// The members of a pod run in the network namespace of its infra container.
+	daemon.Add(podmanContainer(infra, "4f2a-infra", dockertest.Endpoint{Network: "podman", IPAddress: "10.88.0.3"}))
+	member := dockertest.NewContainer(app, "app")
+	member.HostConfig.NetworkMode = container.NetworkMode("container:" + infra)
+	daemon.Add(member)
+
+	dd := newTestDiscovery(t, daemon, "docker {\n domain docker.loc\n runtime podman\n}")
+	startTestDiscovery(t, dd)
+
+	_, m := lookup(dd, "web.docker.loc", dns.TypeA)
+	assert.Equal(t, []string{"10.88.0.2"}, answerIPs(m))
+	_, m = lookup(dd, "app.docker.loc", dns.TypeA)
+	assert.Equal(t, []string{"10.88.0.3"}, answerIPs(m))
+	_, m = lookup(dd, "4f2a-infra.docker.loc", dns.TypeA)
+	assert.Equal(t, []string{"10.88.0.3"}, answerIPs(m))
+
+	daemon.Stop(web)
+	assert.Eventually(t, func() bool {
+		_, m := lookup(dd, "web.docker.loc", dns.TypeA)
+		return m == nil
+	}, 5*time.Second, time.Millisecond)
+
+	// Moving the pod to another network moves its members along.
+	daemon.Disconnect(infra, "podman")
+	daemon.Connect(infra, dockertest.Endpoint{Network: "lan", IPAddress: "192.168.1.10"})
+	assert.Eventually(t, func() bool {
+		_, m := lookup(dd, "app.docker.loc", dns.TypeA)
+		return len(answerIPs(m)) == 1 && answerIPs(m)[0] == "192.168.1.10"
+	}, 5*time.Second, time.Millisecond)
+
+	daemon.Stop(app)
+	assert.Eventually(t, func() bool {
+		_, m := lookup(dd, "app.docker.loc", dns.TypeA)
+		return m == nil
+	}, 5*time.Second, time.Millisecond)
+}
+
+func TestNormalizeEvent(t *testing.T) {
+	docker := events.Message{
+		Type:   events.NetworkEventType,
+		Action: "connect",
+		Actor: events.Actor{
+			ID:         "7d4e9a8c1b2f",
+			Attributes: map[string]string{"container": dockertest.ContainerID(0), "name": "lan", "type": "macvlan"},
+		},
+	}
+	assert.Equal(t, docker, normalizeEvent(docker))
+
+	podman := events.Message{
+		Type:   events.NetworkEventType,
+		Action: "connect",
+		Actor: events.Actor{
+			ID:         dockertest.ContainerID(0),
+			Attributes: map[string]string{"name": "web", "network": "lan"},
+		},
+	}
+	normalized := normalizeEvent(podman)
+	assert.Equal(t, dockertest.ContainerID(0), eventContainerID(normalized))
+	assert.Equal(t, "lan", normalized.Actor.Attributes["name"])
+	assert.Equal(t, "web", podman.Actor.Attributes["name"])
+
+	died := events.Message{Type: events.ContainerEventType, Action: "died", Actor: events.Actor{ID: dockertest.ContainerID(0)}}
+	assert.Equal(t, "die", normalizeEvent(died).Action)
+}
+
+func TestRuntimeSetup(t *testing.T) {
+	dd, err := createPlugin(caddy.NewTestController("dns", "docker {\n runtime podman\n}"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, podmanRuntime.name, dd.runtime.name)
+		assert.Equal(t, podmanDefaultHost(), dd.dockerEndpoint)
+	}
+
+	dd, err = createPlugin(caddy.NewTestController("dns", "docker unix:///run/podman/podman.sock {\n runtime podman\n}"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "unix:///run/podman/podman.sock", dd.dockerEndpoint)
+	}
+
+	for _, config := range []string{
+		"docker {\n runtime\n}",
+		"docker {\n runtime containerd\n}",
+	} {
+		_, err := createPlugin(caddy.NewTestController("dns", config))
+		assert.NotNil(t, err, config)
+	}
+}
@@ -1,14 +1,18 @@
 package docker
 
 import (
+	"encoding/base64"
+	"net"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/coredns/caddy"
 	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
 	clog "github.com/coredns/coredns/plugin/pkg/log"
 	"github.com/docker/docker/client"
-	dockerClient "github.com/docker/docker/client"
+	"github.com/miekg/dns"
 )
 
 const defaultDockerDomain = "docker.local"
@@ -23,7 +27,7 @@ func init() {
 }
 
 // TODO(kevinjqiu): add docker endpoint verification
-func createPlugin(c *caddy.Controller) (Discovery, error) {
+func createPlugin(c *caddy.Controller) (*Discovery, error) {
 	dd := NewDiscovery(c, client.DefaultDockerHost)
 	labelResolvers := &labelResolver{hostLabel: "coredns.dockerdiscovery.host"}
 	dd.resolvers = append(dd.resolvers, labelResolvers)
@@ -31,11 +35,15 @@ func createPlugin(c *caddy.Controller) (Discovery, error) {
 
 	dd.Zone = dnsserver.GetConfig(c).Zone
 	dd.Zones = append(dd.Zones, dd.Zone)
+	dd.metrics.server = serverAddr(dnsserver.GetConfig(c))
+	dd.metrics.instance = dd.Zone
 
+	endpointSet := false // otherwise podman, from_env and context pick the endpoint
 	for c.Next() {
 		args := c.RemainingArgs()
 		if len(args) == 1 {
 			dd.dockerEndpoint = args[0]
+			endpointSet = true
 		}
 
 		if len(args) > 1 {
@@ -74,6 +82,17 @@ func createPlugin(c *caddy.Controller) (Discovery, error) {
 					return dd, c.ArgErr()
 				}
 				resolver.network = c.Val()
+			case "network_domain":
+				if !c.NextArg() {
+					return dd, c.ArgErr()
+				}
+				var resolver = &networkDomainResolver{
+					domain:  c.Val(),
+					runtime: &dd.runtime,
+				}
+				resolver.networks = c.RemainingArgs()
+				dd.resolvers = append(dd.resolvers, resolver)
+				dd.Zones = append(dd.Zones, resolver.domain)
 			case "label":
 				if !c.NextArg() {
 					return dd, c.ArgErr()
@@ -88,59 +107,366 @@ func createPlugin(c *caddy.Controller) (Discovery, error) {
 					return dd, c.Errf("TTL should be an uint32: '%s' - %+v", c.Val(), err)
 				}
 				dd.TTL = uint32(val)
+			case "reconnect":
+				if !c.NextArg() {
+					return dd, c.ArgErr()
+				}
+				val, err := time.ParseDuration(c.Val())
+				if err != nil || val <= 0 {
+					return dd, c.Errf("reconnect should be a positive duration: '%s'", c.Val())
+				}
+				dd.reconnect = val
+			case "serve_stale":
+				if !c.NextArg() {
+					return dd, c.ArgErr()
+				}
+				val, err := time.ParseDuration(c.Val())
+				if err != nil || val < 0 {
+					return dd, c.Errf("serve_stale should be a non-negative duration: '%s'", c.Val())
+				}
+				dd.serveStale = val
+				if dd.staleFallthrough, err = parseStaleFailure(c); err != nil {
+					return dd, err
+				}
+			case "instance":
+				if !c.NextArg() {
+					return dd, c.ArgErr()
+				}
+				dd.metrics.instance = c.Val()
+			case "domain_metrics":
+				if c.NextArg() {
+					return dd, c.ArgErr()
+				}
+				dd.domainMetrics = true
+			case "sync_workers":
+				if !c.NextArg() {
+					return dd, c.ArgErr()
+				}
+				val, err := strconv.Atoi(c.Val())
+				if err != nil || val < 1 {
+					return dd, c.Errf("sync_workers should be a positive integer: '%s'", c.Val())
+				}
+				dd.syncWorkers = val
+			case "snapshot":
+				args := c.RemainingArgs()
+				if len(args) == 0 || len(args) > 2 {
+					return dd, c.ArgErr()
+				}
+				dd.snapshotFile = args[0]
+				dd.snapshotInterval = defaultSnapshotInterval
+				if len(args) == 2 {
+					val, err := time.ParseDuration(args[1])
+					if err != nil || val <= 0 {
+						return dd, c.Errf("snapshot interval should be a positive duration: '%s'", args[1])
+					}
+					dd.snapshotInterval = val
+				}
+			case "debug_http":
+				if !c.NextArg() {
+					return dd, c.ArgErr()
+				}
+				if _, _, err := net.SplitHostPort(c.Val()); err != nil {
+					return dd, c.Errf("debug_http should be a host:port address: '%s' - %+v", c.Val(), err)
+				}
+				dd.debugHTTP = c.Val()
+			case "export":
+				args := c.RemainingArgs()
+				if len(args) < 2 {
+					return dd, c.ArgErr()
+				}
+				e := &exporter{format: args[0], file: args[1]}
+				switch {
+				case e.format == exportHosts && len(args) == 2:
+				case e.format == exportZone && len(args) <= 3:
+					e.origin = dd.Zone
+					if len(args) == 3 {
+						e.origin = args[2]
+					}
+					e.origin = dns.Fqdn(strings.ToLower(e.origin))
+					if _, ok := dns.IsDomainName(e.origin); !ok {
+						return dd, c.Errf("export zone origin should be a domain name: '%s'", e.origin)
+					}
+				case e.format == exportHosts || e.format == exportZone:
+					return dd, c.ArgErr()
+				default:
+					return dd, c.Errf("unknown export format: '%s'", e.format)
+				}
+				dd.exports = append(dd.exports, e)
+			case "export_delay":
+				if !c.NextArg() {
+					return dd, c.ArgErr()
+				}
+				val, err := time.ParseDuration(c.Val())
+				if err != nil || val <= 0 {
+					return dd, c.Errf("export_delay should be a positive duration: '%s'", c.Val())
+				}
+				dd.exportDelay = val
+			case "runtime":
+				if !c.NextArg() {
+					return dd, c.ArgErr()
+				}
+				runtime, ok := runtimes[c.Val()]
+				if !ok {
+					return dd, c.Errf("unknown runtime: '%s'", c.Val())
+				}
+				dd.runtime = runtime
+			case "ipv6":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return dd, c.ArgErr()
+				}
+				dd.ipv6Scope = 0
+				for _, arg := range args {
+					scope, ok := ipv6Scopes[arg]
+					if !ok {
+						return dd, c.Errf("unknown ipv6 scope: '%s'", arg)
+					}
+					dd.ipv6Scope |= scope
+				}
+			case "prefer_driver":
+				dd.preferDrivers = c.RemainingArgs()
+				if len(dd.preferDrivers) == 0 {
+					return dd, c.ArgErr()
+				}
+			case "host_ports":
+				dd.hostPorts = true
+				for _, arg := range c.RemainingArgs() {
+					ip := net.ParseIP(arg)
+					switch {
+					case ip == nil || ip.IsUnspecified():
+						return dd, c.Errf("invalid host address: '%s'", arg)
+					case ip.To4() != nil && dd.hostAddress == nil:
+						dd.hostAddress = ip
+					case ip.To4() == nil && dd.hostAddressV6 == nil:
+						dd.hostAddressV6 = ip
+					default:
+						return dd, c.Errf("more than one host address of the family of '%s'", arg)
+					}
+				}
+			case "on_stop":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return dd, c.ArgErr()
+				}
+				policy, ok := stopPolicies[args[0]]
+				if !ok {
+					return dd, c.Errf("unknown on_stop policy: '%s'", args[0])
+				}
+				dd.onStop = policy
+				for i := 1; i < len(args); i++ {
+					if args[i] == "grace" {
+						if i+1 == len(args) {
+							return dd, c.ArgErr()
+						}
+						i++
+						val, err := time.ParseDuration(args[i])
+						if err != nil || val <= 0 {
+							return dd, c.Errf("on_stop grace should be a positive duration: '%s'", args[i])
+						}
+						dd.stopGrace = val
+						continue
+					}
+					ip := net.ParseIP(args[i])
+					switch {
+					case policy != stopSinkhole || ip == nil:
+						return dd, c.Errf("unexpected on_stop argument: '%s'", args[i])
+					case ip.To4() != nil && dd.sinkhole == nil:
+						dd.sinkhole = ip
+					case ip.To4() == nil && dd.sinkholeV6 == nil:
+						dd.sinkholeV6 = ip
+					default:
+						return dd, c.Errf("more than one sinkhole address of the family of '%s'", args[i])
+					}
+				}
+				if policy == stopSinkhole && dd.sinkhole == nil && dd.sinkholeV6 == nil {
+					return dd, c.Errf("on_stop sinkhole needs a sinkhole address")
+				}
+			case "record":
+				args := c.RemainingArgs()
+				if len(args) < 3 {
+					return dd, c.ArgErr()
+				}
+				name := dns.Fqdn(strings.ToLower(args[0]))
+				rdata := args[1:]
+				// the TTL of the records is that of the ttl directive
+				if _, ok := dns.StringToType[strings.ToUpper(rdata[0])]; !ok {
+					return dd, c.Errf("record should be NAME TYPE RDATA, without a TTL: '%s'", strings.Join(args, " "))
+				}
+				for i, arg := range rdata {
+					if strings.ContainsAny(arg, " \t") { // quoted in the Corefile
+						rdata[i] = `"` + strings.ReplaceAll(arg, `"`, `\"`) + `"`
+					}
+				}
+				rr, err := dns.NewRR(name + " IN " + strings.Join(rdata, " "))
+				if err != nil || rr == nil {
+					return dd, c.Errf("invalid record '%s': %v", strings.Join(args, " "), err)
+				}
+				if rr.Header().Rrtype == dns.TypeSOA {
+					return dd, c.Errf("SOA records cannot be declared: '%s'", args[0])
+				}
+				if dd.static == nil {
+					dd.static = make(map[string][]dns.RR)
+				}
+				dd.static[name] = append(dd.static[name], rr)
+			case "alias":
+				args := c.RemainingArgs()
+				if len(args) != 2 {
+					return dd, c.ArgErr()
+				}
+				if dd.aliases == nil {
+					dd.aliases = make(map[string]string)
+				}
+				dd.aliases[dns.Fqdn(strings.ToLower(args[0]))] = strings.TrimPrefix(args[1], "/")
+			case "update":
+				args := c.RemainingArgs()
+				if len(args) != 2 {
+					return dd, c.ArgErr()
+				}
+				if _, _, err := net.SplitHostPort(args[1]); err != nil {
+					return dd, c.Errf("update should listen on HOST:PORT: '%s'", args[1])
+				}
+				dd.updates = newUpdateRegistry(args[0])
+				dd.updateAddress = args[1]
+			case "tsig_key":
+				args := c.RemainingArgs()
+				if len(args) != 2 && len(args) != 3 {
+					return dd, c.ArgErr()
+				}
+				if _, err := base64.StdEncoding.DecodeString(args[1]); err != nil {
+					return dd, c.Errf("tsig_key secret should be base64: '%s'", args[1])
+				}
+				key := tsigKey{algorithm: dns.HmacSHA256, secret: args[1]}
+				if len(args) == 3 {
+					algorithm, ok := tsigAlgorithms[strings.ToLower(args[2])]
+					if !ok {
+						return dd, c.Errf("unknown tsig_key algorithm: '%s'", args[2])
+					}
+					key.algorithm = algorithm
+				}
+				if dd.tsigKeys == nil {
+					dd.tsigKeys = make(map[string]tsigKey)
+				}
+				dd.tsigKeys[dns.Fqdn(strings.ToLower(args[0]))] = key
+			case "ssh_key":
+				if !c.NextArg() {
+					return dd, c.ArgErr()
+				}
+				dd.sshKey = c.Val()
+			case "ssh_known_hosts":
+				if !c.NextArg() {
+					return dd, c.ArgErr()
+				}
+				dd.sshKnownHosts = c.Val()
+			case "from_env":
+				if c.NextArg() {
+					return dd, c.ArgErr()
+				}
+				dd.fromEnv = true
+			case "context":
+				if !c.NextArg() {
+					return dd, c.ArgErr()
+				}
+				dd.contextName = c.Val()
+			case "strict":
+				var err error
+				dd.serveStale = 0
+				if dd.staleFallthrough, err = parseStaleFailure(c); err != nil {
+					return dd, err
+				}
 			default:
 				return dd, c.Errf("unknown property: '%s'", c.Val())
 			}
 		}
 	}
+	if err := dd.checkStaticRecords(); err != nil {
+		return dd, c.Err(err.Error())
+	}
+	switch {
+	case dd.updates != nil && len(dd.tsigKeys) == 0:
+		return dd, c.Err("update needs a tsig_key to verify the updates with")
+	case dd.updates == nil && len(dd.tsigKeys) > 0:
+		return dd, c.Err("tsig_key is only used with update")
+	case dd.snapshotFile != "" && dd.serveStale == 0:
+		// the records of a snapshot are stale until the first sync
+		return dd, c.Err("snapshot cannot be combined with strict or serve_stale 0s, which never serve its records")
+	}
 	var err error
-
-	// todo add options for tls connections and other
-	dd.dockerClient, err = dockerClient.NewClientWithOpts(dockerClient.WithHost(dd.dockerEndpoint))
+	switch {
+	case (dd.fromEnv || dd.contextName != "") && endpointSet:
+		return dd, c.Err("the docker endpoint cannot be combined with from_env or context")
+	case dd.fromEnv && dd.contextName != "":
+		return dd, c.Err("from_env and context are mutually exclusive")
+	case dd.fromEnv:
+		err = dd.useDockerEnv()
+	case dd.contextName == defaultDockerContext:
+		dd.useDockerHost()
+	case dd.contextName != "":
+		var configDir string
+		if configDir, err = dockerConfigDir(); err == nil {
+			err = dd.useDockerContext(configDir, dd.contextName)
+		}
+	case dd.runtime.name == podmanRuntime.name && !endpointSet:
+		dd.dockerEndpoint = podmanDefaultHost()
+	}
+	if err != nil {
+		return dd, c.Errf("unable to configure the docker endpoint: %v", err)
+	}
+	dd.dockerClient, err = dd.newDockerClient()
 	if err != nil {
 		return dd, err
 	}
 
-	go func() {
-		err = dd.start()
-		if err != nil {
-			log.Errorf("[zone/%s] processing finished with error: %+v", dd.Zone, err)
-		}
-	}()
 	return dd, nil
 }
 
+// serverAddr returns the address of the server block a config belongs to,
+// as reported by metrics.WithServer for the queries it serves.
+func serverAddr(config *dnsserver.Config) string {
+	host := ""
+	if len(config.ListenHosts) > 0 {
+		host = config.ListenHosts[0]
+	}
+	addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(host, config.Port))
+	if err != nil {
+		return config.Transport + "://" + net.JoinHostPort(host, config.Port)
+	}
+	return config.Transport + "://" + addr.String()
+}
+
+// parseStaleFailure reads the optional action taken once stale records
+// expire: "servfail" (the default) or "fallthrough".
+func parseStaleFailure(c *caddy.Controller) (bool, error) {
+	args := c.RemainingArgs()
+	if len(args) == 0 {
+		return false, nil
+	}
+	if len(args) > 1 {
+		return false, c.ArgErr()
+	}
+	switch args[0] {
+	case "servfail":
+		return false, nil
+	case "fallthrough":
+		return true, nil
+	}
+	return false, c.Errf("unknown stale failure action: '%s'", args[0])
+}
+
 func setup(c *caddy.Controller) error {
 	dd, err := createPlugin(c)
 	if err != nil {
 		return err
 	}
 
-	c.OnStartup(func() error {
-		return nil
-	})
-
-	c.OnFirstStartup(func() error {
-		return nil
-	})
-
-	c.OnRestart(func() error {
-		return nil
-	})
-
-	c.OnRestartFailed(func() error {
-		return nil
-	})
+	// Every Corefile reload creates a new instance; the old one is stopped by
+	// OnShutdown so its event stream and goroutines do not outlive it.
+	c.OnStartup(dd.startup)
+	c.OnShutdown(dd.shutdown)
 
-	c.OnShutdown(func() error {
-		//log.Info("Shutting down docker discovery")
-		return nil
-	})
-
-	c.OnFinalShutdown(func() error {
-		//log.Info("Final Shutting down docker discovery")
-		return dd.dockerClient.Close()
-	})
+	// The metrics of the instance are dropped and its debug endpoint stopped
+	// before its successor starts, the successor recreates them.
+	c.OnRestart(dd.onRestart)
+	c.OnRestartFailed(dd.onRestartFailed)
 
 	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
 		dd.Next = next
@@ -3,7 +3,12 @@ package docker
 import (
 	"fmt"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/coredns/caddy"
 	"github.com/docker/docker/api/types"
@@ -117,3 +122,81 @@ func TestSetupDockerDiscovery(t *testing.T) {
 	assert.NotNil(t, containerInfoData)
 	assert.Equal(t, containerData.Name, containerInfoData.container.Name)
 }
+
+func TestNetworkAliasesShortID(t *testing.T) {
+	id := "dbcafe0123456789abcdef0123456789abcdef0123456789abcdef0123456789"
+	containerData := &types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{ID: id, Name: "/postgres"},
+		NetworkSettings: &types.NetworkSettings{
+			Networks: map[string]*network.EndpointSettings{
+				"backend": {Aliases: []string{"db", "dbcafe", id[:12]}},
+			},
+		},
+	}
+	// Real aliases that are a prefix of the ID are kept, only the short ID
+	// daemons add is dropped.
+	domains, err := networkAliasesResolver{network: "backend"}.resolve(containerData)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"db", "dbcafe"}, domains)
+}
+
+// newEventStreamServer serves a docker API over HTTP with no containers
+// whose event stream stays open until the client goes away. Every accepted
+// event stream is signalled on the returned channel.
+func newEventStreamServer(t *testing.T) (*httptest.Server, chan struct{}) {
+	connected := make(chan struct{}, 1)
+	server := httptest.NewServer(eventStreamHandler(connected))
+	t.Cleanup(server.Close)
+	return server, connected
+}
+
+func eventStreamHandler(connected chan struct{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/_ping"):
+			w.Header().Set("API-Version", "1.41")
+			fmt.Fprint(w, "OK")
+		case strings.HasSuffix(r.URL.Path, "/containers/json"):
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, "[]")
+		case strings.HasSuffix(r.URL.Path, "/events"):
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			connected <- struct{}{}
+			<-r.Context().Done()
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+// TestReloadDoesNotLeakGoroutines runs against the real docker client, so
+// that its HTTP connections are accounted for as well.
+func TestReloadDoesNotLeakGoroutines(t *testing.T) {
+	server, connected := newEventStreamServer(t)
+	endpoint := strings.Replace(server.URL, "http://", "tcp://", 1)
+
+	baseline := runtime.NumGoroutine()
+
+	for i := 0; i < 10; i++ {
+		c := caddy.NewTestController("dns", fmt.Sprintf("docker %s", endpoint))
+		dd, err := createPlugin(c)
+		assert.Nil(t, err)
+		assert.Nil(t, dd.startup())
+
+		select {
+		case <-connected:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("reload %d: event stream was not opened", i)
+		}
+
+		assert.Nil(t, dd.shutdown())
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > baseline && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.LessOrEqual(t, runtime.NumGoroutine(), baseline)
+}
@@ -0,0 +1,169 @@
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+// snapshotVersion is bumped on every incompatible change of the snapshot
+// format. Snapshots of another version are ignored.
+const snapshotVersion = 1
+
+const defaultSnapshotInterval = 30 * time.Second
+
+type snapshot struct {
+	Version    int                 `json:"version"`
+	Written    time.Time           `json:"written"`
+	Containers []snapshotContainer `json:"containers"`
+}
+
+type snapshotContainer struct {
+	ID        string                   `json:"id"`
+	Name      string                   `json:"name"`
+	Address   net.IP                   `json:"address,omitempty"`
+	AddressV6 net.IP                   `json:"address_v6,omitempty"`
+	Ports     []publishedPort          `json:"ports,omitempty"`
+	Domains   []string                 `json:"domains"`
+	Scoped    map[string]scopedAddress `json:"scoped,omitempty"`
+}
+
+// loadSnapshot fills the registry from the snapshot file so queries can be
+// answered before the first sync with the daemon. The records are treated
+// as stale until that sync replaces them. A missing file is not an error.
+func (dd *Discovery) loadSnapshot() error {
+	data, err := ioutil.ReadFile(dd.snapshotFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var snap snapshot
+	if err = json.Unmarshal(data, &snap); err != nil {
+		return fmt.Errorf("unable to decode snapshot %s: %v", dd.snapshotFile, err)
+	}
+	if snap.Version != snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d in %s", snap.Version, dd.snapshotFile)
+	}
+
+	dd.mutex.Lock()
+	for _, c := range snap.Containers {
+		if len(c.ID) < 12 || len(c.Domains) == 0 {
+			continue
+		}
+		dd.containerInfoMap[c.ID] = &containerInfo{
+			container: &types.ContainerJSON{
+				ContainerJSONBase: &types.ContainerJSONBase{ID: c.ID, Name: c.Name},
+			},
+			address:   c.Address,
+			addressv6: c.AddressV6,
+			ports:     c.Ports,
+			domains:   c.Domains,
+			scoped:    c.Scoped,
+			updated:   snap.Written,
+		}
+	}
+	dd.snapshotGeneration = dd.generation
+	dd.mutex.Unlock()
+
+	log.Infof("[zone/%s] Loaded %d containers from snapshot %s written at %s", dd.Zone, len(snap.Containers), dd.snapshotFile, snap.Written.Format(time.RFC3339))
+	metricsmetricsDockerDomainsUpdate(dd)
+	return nil
+}
+
+// writeSnapshot atomically replaces the snapshot file with the current
+// registry, unless nothing changed since the last write.
+func (dd *Discovery) writeSnapshot() error {
+	dd.mutex.RLock()
+	if dd.generation == dd.snapshotGeneration {
+		dd.mutex.RUnlock()
+		return nil
+	}
+	generation := dd.generation
+	snap := snapshot{
+		Version:    snapshotVersion,
+		Written:    time.Now().UTC(),
+		Containers: make([]snapshotContainer, 0, len(dd.containerInfoMap)),
+	}
+	for id, info := range dd.containerInfoMap {
+		snap.Containers = append(snap.Containers, snapshotContainer{
+			ID:        id,
+			Name:      info.container.Name,
+			Address:   info.address,
+			AddressV6: info.addressv6,
+			Ports:     info.ports,
+			Domains:   info.domains,
+			Scoped:    info.scoped,
+		})
+	}
+	dd.mutex.RUnlock()
+
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	if err = writeFileAtomic(dd.snapshotFile, data, 0600); err != nil {
+		return err
+	}
+
+	dd.mutex.Lock()
+	dd.snapshotGeneration = generation
+	dd.mutex.Unlock()
+	return nil
+}
+
+// snapshotLoop writes the snapshot every snapshotInterval and once more when
+// the instance is shut down.
+func (dd *Discovery) snapshotLoop() {
+	ticker := time.NewTicker(dd.snapshotInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-dd.ctx.Done():
+			if err := dd.writeSnapshot(); err != nil {
+				log.Errorf("[zone/%s] Error writing snapshot: %s", dd.Zone, err)
+			}
+			return
+		case <-ticker.C:
+			if err := dd.writeSnapshot(); err != nil {
+				log.Errorf("[zone/%s] Error writing snapshot: %s", dd.Zone, err)
+			}
+		}
+	}
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames
+// it over path, so readers never see a partially written file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,84 @@
+package docker
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "docker.json")
+	config := "docker {\n domain docker.loc\n snapshot " + file + " 1m\n}"
+
+	dd, err := createPlugin(caddy.NewTestController("dns", config))
+	assert.Nil(t, err)
+	assert.Equal(t, file, dd.snapshotFile)
+
+	err = dd.updateContainerInfo(&types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:   "fa155d6fd141e29256c286070d2d44b3f45f1e46822578f1e7d66c1e7981e6c7",
+			Name: "/web",
+		},
+		Config: &container.Config{},
+		NetworkSettings: &types.NetworkSettings{
+			DefaultNetworkSettings: types.DefaultNetworkSettings{
+				IPAddress:         "172.17.0.2",
+				GlobalIPv6Address: "2001:db8::2",
+			},
+		},
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, dd.writeSnapshot())
+
+	restarted, err := createPlugin(caddy.NewTestController("dns", config))
+	assert.Nil(t, err)
+	assert.Nil(t, restarted.loadSnapshot())
+
+	containerInfoData, err := restarted.containerInfoByDomain("web.docker.loc.")
+	assert.Nil(t, err)
+	assert.NotNil(t, containerInfoData)
+	assert.Equal(t, "fa155d6fd141e29256c286070d2d44b3f45f1e46822578f1e7d66c1e7981e6c7", containerInfoData.container.ID)
+	assert.True(t, containerInfoData.address.Equal(net.ParseIP("172.17.0.2")))
+	assert.True(t, containerInfoData.addressv6.Equal(net.ParseIP("2001:db8::2")))
+
+	// Nothing changed since the load, the file must not be rewritten.
+	assert.Nil(t, ioutil.WriteFile(file, []byte("untouched"), 0644))
+	assert.Nil(t, restarted.writeSnapshot())
+	data, _ := ioutil.ReadFile(file)
+	assert.Equal(t, "untouched", string(data))
+}
+
+func TestSnapshotLoadErrors(t *testing.T) {
+	dir := t.TempDir()
+	dd, err := createPlugin(caddy.NewTestController("dns", "docker {\n snapshot "+filepath.Join(dir, "missing.json")+"\n}"))
+	assert.Nil(t, err)
+	assert.Nil(t, dd.loadSnapshot())
+
+	for name, content := range map[string]string{
+		"garbage.json": "{",
+		"future.json":  `{"version": 99, "containers": []}`,
+	} {
+		file := filepath.Join(dir, name)
+		assert.Nil(t, ioutil.WriteFile(file, []byte(content), 0644))
+		dd.snapshotFile = file
+		assert.NotNil(t, dd.loadSnapshot(), name)
+	}
+	assert.Empty(t, dd.containerInfoMap)
+
+	for _, config := range []string{
+		"docker {\nsnapshot\n}",
+		"docker {\nsnapshot file.json often\n}",
+		"docker {\nsnapshot file.json 1m extra\n}",
+		"docker {\nsnapshot file.json\nstrict\n}",
+		"docker {\nsnapshot file.json\nserve_stale 0s\n}",
+	} {
+		_, err := createPlugin(caddy.NewTestController("dns", config))
+		assert.NotNil(t, err, config)
+	}
+}
@@ -0,0 +1,256 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sync"
+	"time"
+
+	dockerClient "github.com/docker/docker/client"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	defaultSSHPort       = "22"
+	defaultSSHSocket     = "/var/run/docker.sock"
+	sshDialTimeout       = 10 * time.Second
+	sshKeepAliveInterval = 30 * time.Second
+)
+
+// defaultSSHKeys are tried in order when no ssh_key is configured, like ssh does.
+var defaultSSHKeys = []string{"id_ed25519", "id_ecdsa", "id_rsa"}
+
+// sshDialer tunnels connections to the docker socket of a remote host over
+// a single SSH connection, which is established again once it broke.
+type sshDialer struct {
+	addr   string // host:port of the SSH server
+	socket string // path of the docker socket on the remote host
+	config *ssh.ClientConfig
+
+	mutex  sync.Mutex
+	client *ssh.Client
+	closed bool
+}
+
+// sshClient is a docker API client talking to the daemon through an SSH
+// tunnel. Closing it closes the tunnel as well.
+type sshClient struct {
+	*dockerClient.Client
+	dialer *sshDialer
+}
+
+func (c *sshClient) Close() error {
+	err := c.Client.Close()
+	if dialerErr := c.dialer.Close(); err == nil {
+		err = dialerErr
+	}
+	return err
+}
+
+// newSSHClient returns a docker API client for an ssh://[USER@]HOST[:PORT][/SOCKET]
+// endpoint. The remote host must be listed in knownHostsFile, keyFile is the
+// unencrypted private key to authenticate with. Empty files default to the
+// ones of the user's ~/.ssh.
+func newSSHClient(endpoint, keyFile, knownHostsFile, apiVersion string) (*sshClient, error) {
+	dialer, err := newSSHDialer(endpoint, keyFile, knownHostsFile)
+	if err != nil {
+		return nil, err
+	}
+	// The host is only used in the Host header of the requests, the
+	// connections are made by the dialer.
+	client, err := dockerClient.NewClientWithOpts(
+		dockerClient.WithHost("http://docker.example.com"),
+		dockerClient.WithDialContext(dialer.DialContext),
+		dockerClient.WithVersion(apiVersion),
+		dockerClient.WithAPIVersionNegotiation(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &sshClient{Client: client, dialer: dialer}, nil
+}
+
+func newSSHDialer(endpoint, keyFile, knownHostsFile string) (*sshDialer, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ssh" || u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid ssh endpoint: '%s'", endpoint)
+	}
+
+	username := u.User.Username()
+	if username == "" {
+		current, err := user.Current()
+		if err != nil {
+			return nil, fmt.Errorf("unable to determine the ssh user of %s: %v", endpoint, err)
+		}
+		username = current.Username
+	}
+	port := u.Port()
+	if port == "" {
+		port = defaultSSHPort
+	}
+	socket := u.Path
+	if socket == "" || socket == "/" {
+		socket = defaultSSHSocket
+	}
+
+	if keyFile == "" {
+		if keyFile, err = defaultSSHKey(); err != nil {
+			return nil, err
+		}
+	}
+	key, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read ssh key: %v", err)
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse ssh key %s: %v", keyFile, err)
+	}
+
+	if knownHostsFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read ssh known hosts: %v", err)
+	}
+
+	return &sshDialer{
+		addr:   net.JoinHostPort(u.Hostname(), port),
+		socket: socket,
+		config: &ssh.ClientConfig{
+			User:            username,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         sshDialTimeout,
+		},
+	}, nil
+}
+
+// defaultSSHKey returns the first of the default keys of the user that exists.
+func defaultSSHKey() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	for _, name := range defaultSSHKeys {
+		path := filepath.Join(home, ".ssh", name)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("no ssh key found in %s, use ssh_key", filepath.Join(home, ".ssh"))
+}
+
+// DialContext opens a connection to the remote docker socket. It ignores
+// network and addr, which the docker client derives from its fake host.
+func (d *sshDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	client, err := d.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := client.Dial("unix", d.socket)
+	if err != nil {
+		// The SSH connection may have broken since it was last used.
+		d.disconnect(client)
+		return nil, fmt.Errorf("unable to reach %s on %s: %v", d.socket, d.addr, err)
+	}
+	return conn, nil
+}
+
+// connect returns the SSH connection, establishing it if needed.
+func (d *sshDialer) connect(ctx context.Context) (*ssh.Client, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.closed {
+		return nil, fmt.Errorf("ssh tunnel to %s is closed", d.addr)
+	}
+	if d.client != nil {
+		return d.client, nil
+	}
+
+	var dialer net.Dialer
+	dialCtx, cancel := context.WithTimeout(ctx, sshDialTimeout)
+	defer cancel()
+	conn, err := dialer.DialContext(dialCtx, "tcp", d.addr)
+	if err != nil {
+		return nil, err
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, d.addr, d.config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	d.client = ssh.NewClient(c, chans, reqs)
+	go d.keepAlive(d.client)
+	return d.client, nil
+}
+
+// keepAlive probes the SSH connection and closes it once the server stops
+// answering, so a long running event stream over a dead connection fails and
+// is reconnected rather than hanging.
+func (d *sshDialer) keepAlive(client *ssh.Client) {
+	done := make(chan error, 1)
+	go func() { done <- client.Wait() }()
+
+	ticker := time.NewTicker(sshKeepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			d.disconnect(client)
+			return
+		case <-ticker.C:
+			reply := make(chan error, 1)
+			go func() {
+				_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+				reply <- err
+			}()
+			select {
+			case err := <-reply:
+				if err == nil {
+					continue
+				}
+			case <-time.After(sshKeepAliveInterval):
+			}
+			d.disconnect(client)
+			return
+		}
+	}
+}
+
+// disconnect closes client and forgets it if it is the current connection.
+func (d *sshDialer) disconnect(client *ssh.Client) {
+	d.mutex.Lock()
+	if d.client == client {
+		d.client = nil
+	}
+	d.mutex.Unlock()
+	client.Close()
+}
+
+// Close closes the SSH connection. The dialer cannot be used afterwards.
+func (d *sshDialer) Close() error {
+	d.mutex.Lock()
+	client := d.client
+	d.client, d.closed = nil, true
+	d.mutex.Unlock()
+	if client == nil {
+		return nil
+	}
+	return client.Close()
+}
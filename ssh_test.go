@@ -0,0 +1,193 @@
+package docker
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// newSSHKey generates a key pair and writes the private key to dir.
+func newSSHKey(t *testing.T, dir, name string) (ssh.Signer, string) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, name)
+	if err = ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer, file
+}
+
+// newSSHServer starts an SSH server accepting the client key, which
+// forwards streamlocal channels to the unix sockets of this host.
+func newSSHServer(t *testing.T, hostKey ssh.Signer, clientKey ssh.PublicKey) string {
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() == "docker" && string(key.Marshal()) == string(clientKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, io.EOF
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveSSH(conn, config)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func serveSSH(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "direct-streamlocal@openssh.com" {
+			newChannel.Reject(ssh.UnknownChannelType, "unsupported")
+			continue
+		}
+		var payload struct {
+			SocketPath string
+			Reserved0  string
+			Reserved1  uint32
+		}
+		if err := ssh.Unmarshal(newChannel.ExtraData(), &payload); err != nil {
+			newChannel.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		socket, err := net.Dial("unix", payload.SocketPath)
+		if err != nil {
+			newChannel.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			socket.Close()
+			continue
+		}
+		go ssh.DiscardRequests(requests)
+		go func() {
+			io.Copy(socket, channel)
+			socket.Close()
+		}()
+		go func() {
+			io.Copy(channel, socket)
+			channel.Close()
+		}()
+	}
+}
+
+// newSSHDocker serves the event stream server of setup_test.go on a unix
+// socket behind an SSH server. It returns the endpoint and the files the
+// plugin needs to connect.
+func newSSHDocker(t *testing.T) (endpoint, key, knownHostsFile string, connected chan struct{}) {
+	dir := t.TempDir()
+	server, connected := newEventStreamServer(t)
+	socket := filepath.Join(dir, "docker.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := &http.Server{Handler: server.Config.Handler}
+	go api.Serve(ln)
+	t.Cleanup(func() { api.Close() })
+
+	hostKey, _ := newSSHKey(t, dir, "host")
+	clientKey, key := newSSHKey(t, dir, "id_ed25519")
+	addr := newSSHServer(t, hostKey, clientKey.PublicKey())
+
+	knownHostsFile = filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(addr)}, hostKey.PublicKey())
+	if err = ioutil.WriteFile(knownHostsFile, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return "ssh://docker@" + addr + socket, key, knownHostsFile, connected
+}
+
+func TestSSHEndpoint(t *testing.T) {
+	endpoint, key, knownHostsFile, connected := newSSHDocker(t)
+
+	dd, err := createPlugin(caddy.NewTestController("dns", "docker "+endpoint+" {\n ssh_key "+key+"\n ssh_known_hosts "+knownHostsFile+"\n}"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, dd.startup())
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("event stream was not opened through the ssh tunnel")
+	}
+	assert.Eventually(t, dd.Ready, 5*time.Second, time.Millisecond)
+	assert.NoError(t, dd.shutdown())
+}
+
+func TestSSHUnknownHost(t *testing.T) {
+	endpoint, key, _, _ := newSSHDocker(t)
+	other, _ := newSSHKey(t, t.TempDir(), "other")
+	knownHostsFile := filepath.Join(t.TempDir(), "known_hosts")
+	addr := strings.SplitN(strings.TrimPrefix(endpoint, "ssh://docker@"), "/", 2)[0]
+	line := knownhosts.Line([]string{knownhosts.Normalize(addr)}, other.PublicKey())
+	assert.NoError(t, ioutil.WriteFile(knownHostsFile, []byte(line+"\n"), 0600))
+
+	dd, err := createPlugin(caddy.NewTestController("dns", "docker "+endpoint+" {\n ssh_key "+key+"\n ssh_known_hosts "+knownHostsFile+"\n}"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer dd.dockerClient.Close()
+	err = dd.resync()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "key mismatch")
+	}
+}
+
+func TestSSHSetup(t *testing.T) {
+	_, key, knownHostsFile, _ := newSSHDocker(t)
+	for _, config := range []string{
+		"docker ssh://docker@127.0.0.1 {\n ssh_key\n}",
+		"docker ssh://docker@127.0.0.1 {\n ssh_known_hosts\n}",
+		"docker ssh://docker@127.0.0.1 {\n ssh_key " + knownHostsFile + "\n ssh_known_hosts " + knownHostsFile + "\n}",
+		"docker ssh://docker@127.0.0.1 {\n ssh_key " + key + "\n ssh_known_hosts " + key + ".missing\n}",
+		"docker ssh:///var/run/docker.sock {\n ssh_key " + key + "\n ssh_known_hosts " + knownHostsFile + "\n}",
+	} {
+		_, err := createPlugin(caddy.NewTestController("dns", config))
+		assert.NotNil(t, err, config)
+	}
+}
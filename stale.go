@@ -0,0 +1,77 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/miekg/dns"
+)
+
+// serveStaleForever keeps answering from the last known records for as long
+// as the docker daemon is unreachable. This is the default policy.
+const serveStaleForever time.Duration = -1
+
+// markStale records the moment the registry stopped being kept in sync with
+// the daemon. Later calls keep the original moment. Records are not marked
+// stale once the instance is shut down.
+func (dd *Discovery) markStale() {
+	if dd.ctx.Err() != nil {
+		return
+	}
+	if atomic.CompareAndSwapInt64(&dd.staleSince, 0, time.Now().UnixNano()) {
+		dd.metrics.gauge(metricsDockerStale).Set(1)
+		if dd.serveStale != 0 {
+			log.Warningf("[zone/%s] docker is unreachable, serving stale records", dd.Zone)
+		}
+	}
+}
+
+// markFresh records that the registry is in sync with the daemon again.
+func (dd *Discovery) markFresh() {
+	if atomic.SwapInt64(&dd.staleSince, 0) != 0 {
+		atomic.StoreInt32(&dd.staleExpired, 0)
+		dd.metrics.gauge(metricsDockerStale).Set(0)
+		log.Infof("[zone/%s] docker is reachable, records are in sync", dd.Zone)
+	}
+}
+
+// staleness reports whether the registry is out of sync with the daemon and
+// whether it has been so for longer than the serve_stale policy allows.
+func (dd *Discovery) staleness() (stale bool, expired bool) {
+	since := atomic.LoadInt64(&dd.staleSince)
+	if since == 0 {
+		return false, false
+	}
+	if dd.serveStale == serveStaleForever {
+		return true, false
+	}
+	return true, time.Since(time.Unix(0, since)) > dd.serveStale
+}
+
+// explainStale adds an Extended DNS Error to m while the records are served
+// out of sync with the daemon.
+func (dd *Discovery) explainStale(m *dns.Msg) {
+	since := atomic.LoadInt64(&dd.staleSince)
+	if since == 0 {
+		return
+	}
+	age := time.Since(time.Unix(0, since)).Round(time.Second)
+	setEDE(m, edeStaleAnswer, fmt.Sprintf("docker unreachable for %s, records may be stale", age))
+}
+
+// refuseStale answers a query for one of our zones once the stale records
+// can no longer be served: either SERVFAIL or handing it to the next plugin.
+func (dd *Discovery) refuseStale(ctx context.Context, w dns.ResponseWriter, r *dns.Msg, zone string) (int, error) {
+	if atomic.CompareAndSwapInt32(&dd.staleExpired, 0, 1) {
+		log.Errorf("[zone/%s] docker has been unreachable for longer than %s, refusing to serve stale records", dd.Zone, dd.serveStale)
+	}
+	if dd.staleFallthrough {
+		dd.metrics.counter(metricsDockerStaleRequests, zone, "fallthrough").Inc()
+		return plugin.NextOrFailure(dd.Name(), dd.Next, ctx, w, r)
+	}
+	dd.metrics.counter(metricsDockerStaleRequests, zone, "servfail").Inc()
+	return dns.RcodeServerFailure, nil
+}
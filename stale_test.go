@@ -0,0 +1,77 @@
+package docker
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/miekg/dns"
+	"github.com/rb-coredns/coredns-docker-discovery/dockertest"
+	"github.com/stretchr/testify/assert"
+)
+
+type staleTestCase struct {
+	configBlock   string
+	staleFor      time.Duration // zero means in sync
+	expectedRcode int
+	expectAnswer  bool
+}
+
+func TestServeStale(t *testing.T) {
+	testCases := []staleTestCase{
+		{"docker { domain docker.loc\n}", 0, dns.RcodeSuccess, true},
+		{"docker { domain docker.loc\n}", time.Hour, dns.RcodeSuccess, true},
+		{"docker { domain docker.loc\nserve_stale 1m\n}", time.Second, dns.RcodeSuccess, true},
+		{"docker { domain docker.loc\nserve_stale 1m\n}", time.Hour, dns.RcodeServerFailure, false},
+		{"docker { domain docker.loc\nserve_stale 1m fallthrough\n}", time.Hour, dns.RcodeRefused, false},
+		{"docker { domain docker.loc\nstrict\n}", 0, dns.RcodeSuccess, true},
+		{"docker { domain docker.loc\nstrict\n}", time.Second, dns.RcodeServerFailure, false},
+		{"docker { domain docker.loc\nstrict servfail\n}", time.Second, dns.RcodeServerFailure, false},
+	}
+
+	daemon := dockertest.New()
+	daemon.Add(dockertest.NewContainer(dockertest.ContainerID(0), "web", dockertest.Endpoint{Network: "bridge", IPAddress: "172.17.0.2"}))
+
+	for _, tc := range testCases {
+		dd := newTestDiscovery(t, daemon, tc.configBlock)
+		assert.Nil(t, dd.resync())
+
+		since := int64(0)
+		if tc.staleFor > 0 {
+			since = time.Now().Add(-tc.staleFor).UnixNano()
+		}
+		atomic.StoreInt64(&dd.staleSince, since)
+
+		rcode, m := lookup(dd, "web.docker.loc", dns.TypeA)
+		assert.Equal(t, tc.expectedRcode, rcode, tc.configBlock)
+		if tc.expectAnswer {
+			assert.Equal(t, []string{"172.17.0.2"}, answerIPs(m), tc.configBlock)
+		} else {
+			assert.Nil(t, m, tc.configBlock)
+		}
+	}
+}
+
+func TestShutdownIsNotStale(t *testing.T) {
+	daemon := dockertest.New()
+	dd := newTestDiscovery(t, daemon, "docker {\n domain docker.loc\n}")
+	startTestDiscovery(t, dd)
+
+	assert.NoError(t, dd.shutdown())
+	assert.False(t, dd.Ready())
+	assert.Equal(t, int64(0), atomic.LoadInt64(&dd.staleSince))
+}
+
+func TestServeStaleSetup(t *testing.T) {
+	for _, config := range []string{
+		"docker {\nserve_stale\n}",
+		"docker {\nserve_stale soon\n}",
+		"docker {\nserve_stale -1s\n}",
+		"docker {\nserve_stale 1m refuse\n}",
+		"docker {\nstrict servfail fallthrough\n}",
+	} {
+		_, err := createPlugin(caddy.NewTestController("dns", config))
+		assert.NotNil(t, err, config)
+	}
+}
@@ -0,0 +1,166 @@
+package docker
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/miekg/dns"
+)
+
+// maxCNAMEChain is how many CNAMEs in a row are followed within the zones.
+const maxCNAMEChain = 8
+
+// checkStaticRecords checks that the names of the record and alias
+// directives are in the zones of the instance and that a CNAME or an alias
+// is the only record of its name. It sets the TTL of the records.
+func (dd *Discovery) checkStaticRecords() error {
+	for name, records := range dd.static {
+		if plugin.Zones(dd.Zones).Matches(name) == "" {
+			return fmt.Errorf("record %s is outside the zones %s", name, strings.Join(dd.Zones, ", "))
+		}
+		if _, ok := dd.aliases[name]; ok {
+			return fmt.Errorf("%s is both a record and an alias", name)
+		}
+		for _, rr := range records {
+			if rr.Header().Rrtype == dns.TypeCNAME && len(records) > 1 {
+				return fmt.Errorf("record %s has a CNAME and other records", name)
+			}
+			rr.Header().Ttl = dd.TTL
+		}
+	}
+	for name := range dd.aliases {
+		if plugin.Zones(dd.Zones).Matches(name) == "" {
+			return fmt.Errorf("alias %s is outside the zones %s", name, strings.Join(dd.Zones, ", "))
+		}
+	}
+	return nil
+}
+
+// staticRecords returns the records of the record directives, or the
+// addresses of the container of an alias directive, answering a query for
+// name. It reports whether name is one of theirs. Aliases are answered empty
+// once stale records are no longer served.
+func (dd *Discovery) staticRecords(name string, qtype uint16) ([]dns.RR, bool) {
+	name = strings.ToLower(name)
+	if records, ok := dd.static[name]; ok {
+		var answers []dns.RR
+		for _, rr := range records {
+			if rr.Header().Rrtype == qtype || rr.Header().Rrtype == dns.TypeCNAME {
+				answers = append(answers, dns.Copy(rr))
+			}
+		}
+		return answers, true
+	}
+
+	target, ok := dd.aliases[name]
+	if !ok {
+		return nil, false
+	}
+	if _, expired := dd.staleness(); expired {
+		return nil, true
+	}
+	info := dd.containerInfoByName(target)
+	if info == nil {
+		return nil, true
+	}
+	address, addressv6 := dd.addressesFor(info, name)
+	switch qtype {
+	case dns.TypeA:
+		return dd.a(name, []net.IP{address}), true
+	case dns.TypeAAAA:
+		return dd.aaaa(name, []net.IP{addressv6}), true
+	}
+	return nil, true
+}
+
+// isAlias reports whether name is the name of an alias directive, whose
+// addresses come from docker.
+func (dd *Discovery) isAlias(name string) bool {
+	_, ok := dd.aliases[strings.ToLower(name)]
+	return ok
+}
+
+// containerInfoByName returns the record of the container with the given
+// name, preferring a running container over a stopped one. It returns nil
+// if there is none.
+func (dd *Discovery) containerInfoByName(name string) *containerInfo {
+	dd.mutex.RLock()
+	defer dd.mutex.RUnlock()
+
+	var stopped *containerInfo
+	for _, info := range dd.containerInfoMap {
+		if normalizeContainerName(info.container) != name {
+			continue
+		}
+		if info.stopped.IsZero() {
+			return info
+		}
+		stopped = info
+	}
+	return stopped
+}
+
+// localRecords returns the records of the Corefile or of dynamic updates
+// answering a query for name. It reports false when there are none for
+// name or a container holds it, container records win.
+func (dd *Discovery) localRecords(name string, qtype uint16) ([]dns.RR, bool) {
+	answers, ok := dd.staticRecords(name, qtype)
+	if !ok && dd.updates != nil {
+		answers, ok = dd.updates.lookup(name, qtype)
+	}
+	if !ok {
+		return nil, false
+	}
+	if info, _ := dd.containerInfoByDomain(name); info != nil {
+		return nil, false
+	}
+	return answers, true
+}
+
+// chaseCNAME appends the records of the target of the CNAME answers end
+// with, as long as the target is in the zones of the instance.
+func (dd *Discovery) chaseCNAME(answers []dns.RR, qtype uint16) []dns.RR {
+	if qtype == dns.TypeCNAME {
+		return answers
+	}
+	for i := 0; i < maxCNAMEChain && len(answers) > 0; i++ {
+		cname, ok := answers[len(answers)-1].(*dns.CNAME)
+		if !ok || plugin.Zones(dd.Zones).Matches(cname.Target) == "" {
+			break
+		}
+		target := strings.ToLower(cname.Target)
+		for _, rr := range answers {
+			if strings.EqualFold(rr.Header().Name, target) { // a loop
+				return answers
+			}
+		}
+		answers = append(answers, dd.recordsOf(target, qtype)...)
+	}
+	return answers
+}
+
+// recordsOf returns the records of name with type qtype, or its CNAME,
+// whether they come from a container, the Corefile or dynamic updates.
+// Container records are left out once stale records are no longer served.
+func (dd *Discovery) recordsOf(name string, qtype uint16) []dns.RR {
+	if records, ok := dd.localRecords(name, qtype); ok {
+		return records
+	}
+	if _, expired := dd.staleness(); expired {
+		return nil
+	}
+	info, _ := dd.containerInfoByDomain(name)
+	if info == nil {
+		return nil
+	}
+	address, addressv6 := dd.addressesFor(info, name)
+	switch qtype {
+	case dns.TypeA:
+		return dd.a(name, []net.IP{address})
+	case dns.TypeAAAA:
+		return dd.aaaa(name, []net.IP{addressv6})
+	}
+	return nil
+}
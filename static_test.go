@@ -0,0 +1,137 @@
+package docker
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/miekg/dns"
+	"github.com/rb-coredns/coredns-docker-discovery/dockertest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStaticRecords(t *testing.T) {
+	daemon := dockertest.New()
+	web := dockertest.ContainerID(0)
+	daemon.Add(dockertest.NewContainer(web, "web", dockertest.Endpoint{Network: "bridge", IPAddress: "172.17.0.2"}))
+	dd := newTestDiscovery(t, daemon, `docker {
+ domain docker.loc
+ ttl 30
+ record gateway.docker.loc A 172.17.0.1
+ record gateway.docker.loc TXT "the docker host"
+ record www.docker.loc CNAME web.docker.loc.
+ record web.docker.loc A 10.0.0.1
+}`)
+	startTestDiscovery(t, dd)
+
+	_, m := lookup(dd, "gateway.docker.loc", dns.TypeA)
+	assert.Equal(t, []string{"172.17.0.1"}, answerIPs(m))
+	assert.Equal(t, uint32(30), m.Answer[0].Header().Ttl)
+	_, m = lookup(dd, "gateway.docker.loc", dns.TypeTXT)
+	if assert.Len(t, m.Answer, 1) {
+		assert.Equal(t, []string{"the docker host"}, m.Answer[0].(*dns.TXT).Txt)
+	}
+	_, m = lookup(dd, "gateway.docker.loc", dns.TypeAAAA)
+	assert.True(t, isNoData(m))
+	_, m = lookup(dd, "www.docker.loc", dns.TypeA)
+	if assert.Len(t, m.Answer, 2) {
+		assert.Equal(t, "web.docker.loc.", m.Answer[0].(*dns.CNAME).Target)
+	}
+	assert.Equal(t, []string{"172.17.0.2"}, answerIPs(m))
+
+	// Container records win.
+	_, m = lookup(dd, "web.docker.loc", dns.TypeA)
+	assert.Equal(t, []string{"172.17.0.2"}, answerIPs(m))
+}
+
+func TestAlias(t *testing.T) {
+	daemon := dockertest.New()
+	daemon.AddNetwork("backend", "bridge")
+	db := dockertest.ContainerID(0)
+	daemon.Add(dockertest.NewContainer(db, "postgres-primary", dockertest.Endpoint{Network: "backend", IPAddress: "172.18.0.2", GlobalIPv6Address: "2001:db8::2"}))
+	dd := newTestDiscovery(t, daemon, "docker {\n domain docker.loc\n alias db.docker.loc postgres-primary\n}")
+	startTestDiscovery(t, dd)
+
+	_, m := lookup(dd, "db.docker.loc", dns.TypeA)
+	assert.Equal(t, []string{"172.18.0.2"}, answerIPs(m))
+	_, m = lookup(dd, "db.docker.loc", dns.TypeAAAA)
+	assert.Equal(t, []string{"2001:db8::2"}, answerIPs(m))
+
+	// The alias follows the container when it moves.
+	daemon.Connect(db, dockertest.Endpoint{Network: "bridge", IPAddress: "172.17.0.3"})
+	daemon.Disconnect(db, "backend")
+	assert.Eventually(t, func() bool {
+		_, m := lookup(dd, "db.docker.loc", dns.TypeA)
+		return len(answerIPs(m)) == 1 && answerIPs(m)[0] == "172.17.0.3"
+	}, 5*time.Second, time.Millisecond)
+
+	// and is answered empty while it is gone.
+	daemon.Stop(db)
+	assert.Eventually(t, func() bool {
+		_, m := lookup(dd, "db.docker.loc", dns.TypeA)
+		return isNoData(m)
+	}, 5*time.Second, time.Millisecond)
+}
+
+func TestStaticRecordsStrict(t *testing.T) {
+	daemon := dockertest.New()
+	daemon.Add(dockertest.NewContainer(dockertest.ContainerID(0), "postgres", dockertest.Endpoint{Network: "bridge", IPAddress: "172.17.0.2"}))
+	dd := newTestDiscovery(t, daemon, `docker {
+ domain docker.loc
+ strict
+ record gateway.docker.loc A 172.17.0.1
+ record www.docker.loc CNAME postgres.docker.loc.
+ record api.docker.loc CNAME db.docker.loc.
+ alias db.docker.loc postgres
+}`)
+	assert.Nil(t, dd.resync())
+	atomic.StoreInt64(&dd.staleSince, time.Now().Add(-time.Second).UnixNano())
+
+	rcode, m := lookup(dd, "gateway.docker.loc", dns.TypeA)
+	assert.Equal(t, dns.RcodeSuccess, rcode)
+	assert.Equal(t, []string{"172.17.0.1"}, answerIPs(m))
+	// Aliases and the container records a CNAME points to are not.
+	rcode, _ = lookup(dd, "db.docker.loc", dns.TypeA)
+	assert.Equal(t, dns.RcodeServerFailure, rcode)
+	_, m = lookup(dd, "www.docker.loc", dns.TypeA)
+	if assert.NotNil(t, m) {
+		assert.Len(t, m.Answer, 1)
+	}
+	_, m = lookup(dd, "api.docker.loc", dns.TypeA)
+	if assert.NotNil(t, m) {
+		assert.Len(t, m.Answer, 1)
+	}
+	rcode, _ = lookup(dd, "postgres.docker.loc", dns.TypeA)
+	assert.Equal(t, dns.RcodeServerFailure, rcode)
+}
+
+func TestStaticRecordsSetup(t *testing.T) {
+	create := func(config string) (*Discovery, error) {
+		c := caddy.NewTestController("dns", config)
+		dnsserver.GetConfig(c).Zone = "docker.loc."
+		return createPlugin(c)
+	}
+	dd, err := create("docker {\n record Gateway.docker.loc A 172.17.0.1\n record gateway.docker.loc TXT gateway\n alias db.docker.loc /postgres\n}")
+	if assert.NoError(t, err) {
+		assert.Len(t, dd.static["gateway.docker.loc."], 2)
+		assert.Equal(t, "postgres", dd.aliases["db.docker.loc."])
+	}
+
+	for _, config := range []string{
+		"docker {\n record gateway.docker.loc A\n}",
+		"docker {\n record gateway.docker.loc A not-an-address\n}",
+		"docker {\n record gateway.docker.loc 60 A 172.17.0.1\n}",
+		"docker {\n record gateway.docker.loc IN 60 A 172.17.0.1\n}",
+		"docker {\n record gateway.example.org A 172.17.0.1\n}",
+		"docker {\n record docker.loc SOA ns.docker.loc. hostmaster.docker.loc. 1 7200 1800 86400 60\n}",
+		"docker {\n record www.docker.loc CNAME web.docker.loc.\n record www.docker.loc A 172.17.0.1\n}",
+		"docker {\n record db.docker.loc A 172.17.0.1\n alias db.docker.loc postgres\n}",
+		"docker {\n alias db.docker.loc\n}",
+		"docker {\n alias db.example.org postgres\n}",
+	} {
+		_, err := create(config)
+		assert.NotNil(t, err, config)
+	}
+}
@@ -0,0 +1,102 @@
+package docker
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// stopPolicy is what the names of a container are answered with during the
+// grace period after it stopped.
+type stopPolicy string
+
+const (
+	stopRemove   stopPolicy = "remove"   // forget the names right away
+	stopKeep     stopPolicy = "keep"     // answer the last known addresses
+	stopSinkhole stopPolicy = "sinkhole" // answer the sinkhole addresses
+	stopNXDomain stopPolicy = "nxdomain" // answer NXDOMAIN with an extended DNS error
+
+	defaultStopGrace = time.Minute
+)
+
+var stopPolicies = map[string]stopPolicy{
+	string(stopRemove):   stopRemove,
+	string(stopKeep):     stopKeep,
+	string(stopSinkhole): stopSinkhole,
+	string(stopNXDomain): stopNXDomain,
+}
+
+// markStopped keeps the record of a container that stopped for the grace
+// period of the on_stop policy. It reports false when there is no record
+// to keep.
+func (dd *Discovery) markStopped(containerID string) bool {
+	dd.mutex.Lock()
+	defer dd.mutex.Unlock()
+	delete(dd.skipped, containerID)
+	info, ok := dd.containerInfoMap[containerID]
+	if !ok {
+		return false
+	}
+	if !info.stopped.IsZero() {
+		return true
+	}
+
+	stopped := *info
+	stopped.stopped = time.Now()
+	dd.containerInfoMap[containerID] = &stopped
+	dd.changed()
+	time.AfterFunc(dd.stopGrace, func() { dd.expireStopped(containerID, stopped.stopped) })
+	log.Debugf("[zone/%s] Keeping entry %s (%s) for %s, the container stopped", dd.Zone, normalizeContainerName(info.container), containerID[:12], dd.stopGrace)
+	return true
+}
+
+// expireStopped forgets the record of a stopped container once its grace
+// period is over, unless the container was started again meanwhile.
+func (dd *Discovery) expireStopped(containerID string, since time.Time) {
+	if dd.ctx.Err() != nil {
+		return
+	}
+	dd.mutex.Lock()
+	info, ok := dd.containerInfoMap[containerID]
+	if !ok || !info.stopped.Equal(since) {
+		dd.mutex.Unlock()
+		return
+	}
+	log.Debugf("[zone/%s] Deleting entry %s (%s), the container stopped %s ago", dd.Zone, normalizeContainerName(info.container), containerID[:12], dd.stopGrace)
+	delete(dd.containerInfoMap, containerID)
+	dd.changed()
+	dd.mutex.Unlock()
+
+	dd.forgetDomainMetrics(info.domains)
+	metricsmetricsDockerDomainsUpdate(dd)
+}
+
+// addressesFor returns the addresses name, one of the domains of info, is
+// answered with, following the on_stop policy once the container stopped.
+func (dd *Discovery) addressesFor(info *containerInfo, name string) (net.IP, net.IP) {
+	switch {
+	case info.stopped.IsZero() || dd.onStop == stopKeep:
+		return info.addressesOf(name)
+	case dd.onStop == stopSinkhole:
+		return dd.sinkhole, dd.sinkholeV6
+	}
+	return nil, nil
+}
+
+// explainStopped turns m into the answer for a name of a stopped container:
+// NXDOMAIN with the nxdomain policy, and an Extended DNS Error telling the
+// container stopped.
+func (dd *Discovery) explainStopped(m *dns.Msg, info *containerInfo) {
+	text := fmt.Sprintf("container %s stopped %s ago", normalizeContainerName(info.container), time.Since(info.stopped).Round(time.Second))
+	switch dd.onStop {
+	case stopKeep:
+		setEDE(m, edeStaleAnswer, text)
+	case stopSinkhole:
+		setEDE(m, edeForgedAnswer, text)
+	case stopNXDomain:
+		m.Rcode = dns.RcodeNameError
+		setEDE(m, edeOther, text)
+	}
+}
@@ -0,0 +1,130 @@
+package docker
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/rb-coredns/coredns-docker-discovery/dockertest"
+	"github.com/stretchr/testify/assert"
+)
+
+// lookupEDNS is lookup with a request carrying EDNS0.
+func lookupEDNS(dd *Discovery, name string, qtype uint16) (int, *dns.Msg) {
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(name), qtype)
+	req.SetEdns0(4096, false)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	rcode, _ := dd.ServeDNS(context.Background(), rec, req)
+	return rcode, rec.Msg
+}
+
+// edeOf returns the code and the text of the Extended DNS Error of m.
+func edeOf(m *dns.Msg) (uint16, string, bool) {
+	if m == nil || m.IsEdns0() == nil {
+		return 0, "", false
+	}
+	for _, option := range m.IsEdns0().Option {
+		if local, ok := option.(*dns.EDNS0_LOCAL); ok && local.Code == optionCodeEDE && len(local.Data) >= 2 {
+			return binary.BigEndian.Uint16(local.Data), string(local.Data[2:]), true
+		}
+	}
+	return 0, "", false
+}
+
+func TestOnStop(t *testing.T) {
+	for _, tc := range []struct {
+		policy  string
+		rcode   int
+		answers []string
+		ede     uint16
+	}{
+		{policy: "keep", rcode: dns.RcodeSuccess, answers: []string{"172.17.0.2"}, ede: edeStaleAnswer},
+		{policy: "sinkhole 10.0.0.1", rcode: dns.RcodeSuccess, answers: []string{"10.0.0.1"}, ede: edeForgedAnswer},
+		{policy: "nxdomain", rcode: dns.RcodeNameError, ede: edeOther},
+	} {
+		t.Run(tc.policy, func(t *testing.T) {
+			daemon := dockertest.New()
+			web := dockertest.ContainerID(0)
+			daemon.Add(dockertest.NewContainer(web, "web", dockertest.Endpoint{Network: "bridge", IPAddress: "172.17.0.2"}))
+			dd := newTestDiscovery(t, daemon, "docker {\n domain docker.loc\n on_stop "+tc.policy+" grace 500ms\n}")
+			startTestDiscovery(t, dd)
+
+			daemon.Stop(web)
+			assert.Eventually(t, func() bool {
+				_, m := lookupEDNS(dd, "web.docker.loc", dns.TypeA)
+				_, _, ok := edeOf(m)
+				return ok
+			}, 5*time.Second, time.Millisecond)
+			_, m := lookupEDNS(dd, "web.docker.loc", dns.TypeA)
+			assert.Equal(t, tc.rcode, m.Rcode)
+			assert.Equal(t, tc.answers, answerIPs(m))
+			code, text, _ := edeOf(m)
+			assert.Equal(t, tc.ede, code)
+			assert.Contains(t, text, "container web stopped")
+
+			// Requests without EDNS0 get no extended error.
+			_, m = lookup(dd, "web.docker.loc", dns.TypeA)
+			assert.Equal(t, tc.rcode, m.Rcode)
+			assert.Nil(t, m.IsEdns0())
+
+			// The name goes away with the grace period.
+			assert.Eventually(t, func() bool {
+				rcode, _ := lookup(dd, "web.docker.loc", dns.TypeA)
+				return rcode == dns.RcodeRefused
+			}, 5*time.Second, 10*time.Millisecond)
+		})
+	}
+}
+
+func TestOnStopRestart(t *testing.T) {
+	daemon := dockertest.New()
+	web := dockertest.ContainerID(0)
+	daemon.Add(dockertest.NewContainer(web, "web", dockertest.Endpoint{Network: "bridge", IPAddress: "172.17.0.2"}))
+	dd := newTestDiscovery(t, daemon, "docker {\n domain docker.loc\n on_stop nxdomain grace 200ms\n}")
+	startTestDiscovery(t, dd)
+
+	daemon.Stop(web)
+	assert.Eventually(t, func() bool {
+		_, m := lookup(dd, "web.docker.loc", dns.TypeA)
+		return m != nil && m.Rcode == dns.RcodeNameError
+	}, 5*time.Second, time.Millisecond)
+	daemon.Start(dockertest.NewContainer(web, "web", dockertest.Endpoint{Network: "bridge", IPAddress: "172.17.0.2"}))
+	assert.Eventually(t, func() bool {
+		_, m := lookup(dd, "web.docker.loc", dns.TypeA)
+		return len(answerIPs(m)) == 1
+	}, 5*time.Second, time.Millisecond)
+
+	// The expiry of the grace period of the earlier stop leaves it alone.
+	time.Sleep(300 * time.Millisecond)
+	_, m := lookup(dd, "web.docker.loc", dns.TypeA)
+	assert.Equal(t, []string{"172.17.0.2"}, answerIPs(m))
+}
+
+func TestOnStopSetup(t *testing.T) {
+	dd, err := createPlugin(caddy.NewTestController("dns", "docker {\n on_stop sinkhole 10.0.0.1 ::1 grace 5m\n}"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, stopSinkhole, dd.onStop)
+		assert.Equal(t, "10.0.0.1", dd.sinkhole.String())
+		assert.Equal(t, "::1", dd.sinkholeV6.String())
+		assert.Equal(t, 5*time.Minute, dd.stopGrace)
+	}
+
+	for _, config := range []string{
+		"docker {\n on_stop\n}",
+		"docker {\n on_stop forget\n}",
+		"docker {\n on_stop sinkhole\n}",
+		"docker {\n on_stop sinkhole 10.0.0.1 10.0.0.2\n}",
+		"docker {\n on_stop keep 10.0.0.1\n}",
+		"docker {\n on_stop keep grace\n}",
+		"docker {\n on_stop keep grace 0s\n}",
+	} {
+		_, err := createPlugin(caddy.NewTestController("dns", config))
+		assert.NotNil(t, err, config)
+	}
+}
@@ -0,0 +1,147 @@
+package docker
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Labels of a container describing the HTTPS service it runs.
+const (
+	alpnLabel = "coredns.dockerdiscovery.alpn" // comma-separated ALPN protocol IDs, e.g. h2,h3
+	portLabel = "coredns.dockerdiscovery.port" // the HTTPS port of the container, 443 by default
+)
+
+const defaultHTTPSPort = 443
+
+// serviceBinding returns the HTTPS or SVCB records, as qtype tells, of name,
+// a domain of info, nil if the container advertises no HTTPS service, having
+// none of the labels. With host_ports the protocols are reached on the host
+// port published for their transport, with a record per host port, and there
+// are no records when the HTTPS port is not published for any of them.
+func (dd *Discovery) serviceBinding(name string, info *containerInfo, qtype uint16) []dns.RR {
+	var labels map[string]string
+	if info.container.Config != nil {
+		labels = info.container.Config.Labels
+	}
+
+	var alpn []string
+	for _, id := range strings.Split(labels[alpnLabel], ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			alpn = append(alpn, id)
+		}
+	}
+	port, ok := dd.httpsPort(info, labels)
+	if !ok || (len(alpn) == 0 && labels[portLabel] == "" && !dd.hostPorts) {
+		return nil
+	}
+
+	var hints []dns.SVCBKeyValue
+	address, addressv6 := dd.addressesFor(info, name)
+	if address != nil {
+		hints = append(hints, &dns.SVCBIPv4Hint{Hint: []net.IP{address}})
+	}
+	if addressv6 != nil {
+		hints = append(hints, &dns.SVCBIPv6Hint{Hint: []net.IP{addressv6}})
+	}
+
+	if !dd.hostPorts {
+		return []dns.RR{serviceRecord(name, qtype, dd.TTL, 1, alpn, false, port, hints)}
+	}
+
+	// the ALPN protocol IDs by host port, HTTP/1.1 over TCP without any
+	var hostPorts []uint16
+	byHostPort := make(map[uint16][]string)
+	tcp := make(map[uint16]bool)
+	add := func(id string) {
+		proto := alpnProto(id)
+		hostPort, ok := hostPortOf(info, port, proto)
+		if !ok {
+			return
+		}
+		if _, ok := byHostPort[hostPort]; !ok {
+			hostPorts = append(hostPorts, hostPort)
+			byHostPort[hostPort] = nil
+		}
+		if id != "" {
+			byHostPort[hostPort] = append(byHostPort[hostPort], id)
+		}
+		tcp[hostPort] = tcp[hostPort] || proto == "tcp"
+	}
+	if len(alpn) == 0 {
+		add("")
+	}
+	for _, id := range alpn {
+		add(id)
+	}
+
+	var records []dns.RR
+	for i, hostPort := range hostPorts {
+		// the default http/1.1 is not reached on a port published for UDP only
+		records = append(records, serviceRecord(name, qtype, dd.TTL, uint16(i+1), byHostPort[hostPort], !tcp[hostPort], hostPort, hints))
+	}
+	return records
+}
+
+// serviceRecord returns an HTTPS or SVCB record, as qtype tells.
+func serviceRecord(name string, qtype uint16, ttl uint32, priority uint16, alpn []string, noDefaultAlpn bool, port uint16, hints []dns.SVCBKeyValue) dns.RR {
+	var values []dns.SVCBKeyValue
+	if len(alpn) > 0 {
+		values = append(values, &dns.SVCBAlpn{Alpn: alpn})
+	}
+	if noDefaultAlpn {
+		values = append(values, &dns.SVCBNoDefaultAlpn{})
+	}
+	if port != defaultHTTPSPort {
+		values = append(values, &dns.SVCBPort{Port: port})
+	}
+	values = append(values, hints...)
+
+	svcb := dns.SVCB{
+		Hdr:      dns.RR_Header{Name: name, Rrtype: qtype, Class: dns.ClassINET, Ttl: ttl},
+		Priority: priority,
+		Target:   ".",
+		Value:    values,
+	}
+	if qtype == dns.TypeHTTPS {
+		return &dns.HTTPS{SVCB: svcb}
+	}
+	return &svcb
+}
+
+// alpnProto returns the transport of an ALPN protocol ID: UDP for HTTP/3
+// and its drafts, TCP for the others.
+func alpnProto(id string) string {
+	if id == "h3" || strings.HasPrefix(id, "h3-") {
+		return "udp"
+	}
+	return "tcp"
+}
+
+// httpsPort returns the HTTPS port of a container: its port label, or else
+// 443. It reports false when the label is no port.
+func (dd *Discovery) httpsPort(info *containerInfo, labels map[string]string) (uint16, bool) {
+	value := labels[portLabel]
+	if value == "" {
+		return defaultHTTPSPort, true
+	}
+	port, err := strconv.ParseUint(value, 10, 16)
+	if err != nil || port == 0 {
+		log.Debugf("[zone/%s] Ignoring the %s label of container %s: '%s'", dd.Zone, portLabel, normalizeContainerName(info.container), value)
+		return 0, false
+	}
+	return uint16(port), true
+}
+
+// hostPortOf returns the host port the port/proto of a container is
+// published on, for host_ports.
+func hostPortOf(info *containerInfo, port uint16, proto string) (uint16, bool) {
+	for _, published := range info.ports {
+		if published.Proto == proto && published.Port == port {
+			return published.HostPort, true
+		}
+	}
+	return 0, false
+}
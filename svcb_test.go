@@ -0,0 +1,98 @@
+package docker
+
+import (
+	"testing"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/miekg/dns"
+	"github.com/rb-coredns/coredns-docker-discovery/dockertest"
+	"github.com/stretchr/testify/assert"
+)
+
+// serviceParams returns the SvcParams of the HTTPS or SVCB answer of m.
+func serviceParams(t *testing.T, m *dns.Msg) string {
+	if m == nil || !assert.Len(t, m.Answer, 1) {
+		return ""
+	}
+	switch rr := m.Answer[0].(type) {
+	case *dns.HTTPS:
+		return rr.String()[len(rr.Hdr.String()):]
+	case *dns.SVCB:
+		return rr.String()[len(rr.Hdr.String()):]
+	}
+	t.Errorf("unexpected answer %s", m.Answer[0])
+	return ""
+}
+
+func TestServiceBinding(t *testing.T) {
+	daemon := dockertest.New()
+	web, api, db := dockertest.ContainerID(0), dockertest.ContainerID(1), dockertest.ContainerID(2)
+	c := dockertest.NewContainer(web, "web", dockertest.Endpoint{Network: "bridge", IPAddress: "172.17.0.2", GlobalIPv6Address: "2001:db8::2"})
+	c.Config.Labels[alpnLabel] = "h2, h3"
+	daemon.Add(c)
+	c = dockertest.NewContainer(api, "api", dockertest.Endpoint{Network: "bridge", IPAddress: "172.17.0.3"})
+	c.Config.Labels[portLabel] = "8443"
+	daemon.Add(c)
+	daemon.Add(dockertest.NewContainer(db, "db", dockertest.Endpoint{Network: "bridge", IPAddress: "172.17.0.4"}))
+
+	dd := newTestDiscovery(t, daemon, "docker {\n domain docker.loc\n}")
+	startTestDiscovery(t, dd)
+
+	_, m := lookup(dd, "web.docker.loc", dns.TypeHTTPS)
+	assert.Equal(t, `1 . alpn="h2,h3" ipv4hint="172.17.0.2" ipv6hint="2001:db8::2"`, serviceParams(t, m))
+	_, err := m.Pack()
+	assert.NoError(t, err)
+	_, m = lookup(dd, "web.docker.loc", dns.TypeSVCB)
+	assert.Equal(t, `1 . alpn="h2,h3" ipv4hint="172.17.0.2" ipv6hint="2001:db8::2"`, serviceParams(t, m))
+	_, m = lookup(dd, "api.docker.loc", dns.TypeHTTPS)
+	assert.Equal(t, `1 . port="8443" ipv4hint="172.17.0.3"`, serviceParams(t, m))
+
+	// Containers without the labels advertise no HTTPS service.
+	_, m = lookup(dd, "db.docker.loc", dns.TypeHTTPS)
+	assert.True(t, isNoData(m))
+}
+
+func TestServiceBindingHostPorts(t *testing.T) {
+	daemon := dockertest.New()
+	web, api, quic, both := dockertest.ContainerID(0), dockertest.ContainerID(1), dockertest.ContainerID(2), dockertest.ContainerID(3)
+	c := dockertest.NewContainer(web, "web", dockertest.Endpoint{Network: "bridge", IPAddress: "172.17.0.2"})
+	c.NetworkSettings.Ports = nat.PortMap{"443/tcp": {{HostIP: "0.0.0.0", HostPort: "8443"}}}
+	c.Config.Labels[alpnLabel] = "h2"
+	daemon.Add(c)
+	c = dockertest.NewContainer(api, "api", dockertest.Endpoint{Network: "bridge", IPAddress: "172.17.0.3"})
+	c.NetworkSettings.Ports = nat.PortMap{"80/tcp": {{HostIP: "0.0.0.0", HostPort: "8080"}}}
+	c.Config.Labels[alpnLabel] = "h2"
+	daemon.Add(c)
+	c = dockertest.NewContainer(quic, "quic", dockertest.Endpoint{Network: "bridge", IPAddress: "172.17.0.4"})
+	c.NetworkSettings.Ports = nat.PortMap{"443/udp": {{HostIP: "0.0.0.0", HostPort: "9443"}}}
+	c.Config.Labels[alpnLabel] = "h2,h3"
+	daemon.Add(c)
+	c = dockertest.NewContainer(both, "both", dockertest.Endpoint{Network: "bridge", IPAddress: "172.17.0.5"})
+	c.NetworkSettings.Ports = nat.PortMap{
+		"443/tcp": {{HostIP: "0.0.0.0", HostPort: "8443"}},
+		"443/udp": {{HostIP: "0.0.0.0", HostPort: "9443"}},
+	}
+	c.Config.Labels[alpnLabel] = "h3,h2"
+	daemon.Add(c)
+
+	dd := newTestDiscovery(t, daemon, "docker {\n domain docker.loc\n host_ports 192.168.1.5\n}")
+	startTestDiscovery(t, dd)
+
+	_, m := lookup(dd, "web.docker.loc", dns.TypeHTTPS)
+	assert.Equal(t, `1 . alpn="h2" port="8443" ipv4hint="192.168.1.5"`, serviceParams(t, m))
+
+	// The HTTPS port of api is not published on the host.
+	_, m = lookup(dd, "api.docker.loc", dns.TypeHTTPS)
+	assert.True(t, isNoData(m))
+
+	// HTTP/3 is reached over UDP, HTTP/2 over TCP.
+	_, m = lookup(dd, "quic.docker.loc", dns.TypeHTTPS)
+	assert.Equal(t, `1 . alpn="h3" no-default-alpn="" port="9443" ipv4hint="192.168.1.5"`, serviceParams(t, m))
+	_, m = lookup(dd, "both.docker.loc", dns.TypeHTTPS)
+	if assert.Len(t, m.Answer, 2) {
+		assert.Equal(t, `1 . alpn="h3" no-default-alpn="" port="9443" ipv4hint="192.168.1.5"`, m.Answer[0].String()[len(m.Answer[0].Header().String()):])
+		assert.Equal(t, `2 . alpn="h2" port="8443" ipv4hint="192.168.1.5"`, m.Answer[1].String()[len(m.Answer[1].Header().String()):])
+	}
+	_, err := m.Pack()
+	assert.NoError(t, err)
+}
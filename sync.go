@@ -0,0 +1,100 @@
+package docker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+)
+
+const defaultSyncWorkers = 8
+
+// inspectAttempts bounds how many times a failed container inspect is tried
+// during a sync. Attempts are spaced by a growing multiple of inspectRetryDelay.
+const (
+	inspectAttempts   = 3
+	inspectRetryDelay = 100 * time.Millisecond
+)
+
+// syncContainers inspects the listed containers with syncWorkers concurrent
+// workers and records each of them. It returns early when the instance is
+// shut down.
+func (dd *Discovery) syncContainers(containers []types.Container) error {
+	start := time.Now()
+	dd.metrics.gauge(metricsDockerSyncPending).Set(float64(len(containers)))
+	defer dd.metrics.gauge(metricsDockerSyncPending).Set(0)
+
+	ids := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < dd.syncWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range ids {
+				dd.syncContainer(id)
+				dd.metrics.gauge(metricsDockerSyncPending).Dec()
+			}
+		}()
+	}
+
+feed:
+	for i := range containers {
+		select {
+		case ids <- containers[i].ID:
+		case <-dd.ctx.Done():
+			break feed
+		}
+	}
+	close(ids)
+	wg.Wait()
+
+	if err := dd.ctx.Err(); err != nil {
+		return err
+	}
+	dd.metrics.observer(metricsDockerSyncDuration).Observe(time.Since(start).Seconds())
+	log.Debugf("[zone/%s] Synced %d containers in %s", dd.Zone, len(containers), time.Since(start))
+	return nil
+}
+
+// syncContainer inspects and records a single container. Containers that
+// went away since they were listed are skipped.
+func (dd *Discovery) syncContainer(id string) {
+	container, err := dd.inspectContainer(id)
+	switch {
+	case client.IsErrNotFound(err):
+		dd.metrics.counter(metricsDockerSyncInspects, "gone").Inc()
+		log.Debugf("[zone/%s] Container %s went away during sync", dd.Zone, id[:12])
+		return
+	case err != nil:
+		dd.metrics.counter(metricsDockerSyncInspects, "error").Inc()
+		if dd.ctx.Err() == nil {
+			log.Errorf("[zone/%s] Error inspecting container %s: %s", dd.Zone, id[:12], err)
+		}
+		return
+	}
+
+	dd.metrics.counter(metricsDockerSyncInspects, "ok").Inc()
+	if err = dd.updateContainerInfo(&container); err != nil {
+		log.Errorf("[zone/%s] Error adding A record for container %s: %+v", dd.Zone, id[:12], err)
+	}
+}
+
+// inspectContainer inspects a container, retrying failures other than the
+// container not existing up to inspectAttempts times.
+func (dd *Discovery) inspectContainer(id string) (types.ContainerJSON, error) {
+	for attempt := 1; ; attempt++ {
+		container, err := dd.dockerClient.ContainerInspect(dd.ctx, id)
+		dd.countAPIError("inspect", err)
+		if err == nil || client.IsErrNotFound(err) || attempt == inspectAttempts {
+			return container, err
+		}
+		log.Debugf("[zone/%s] Inspecting container %s failed (attempt %d/%d): %s", dd.Zone, id[:12], attempt, inspectAttempts, err)
+
+		select {
+		case <-dd.ctx.Done():
+			return container, dd.ctx.Err()
+		case <-time.After(time.Duration(attempt) * inspectRetryDelay):
+		}
+	}
+}
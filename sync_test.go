@@ -0,0 +1,74 @@
+package docker
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/docker/docker/api/types"
+	"github.com/rb-coredns/coredns-docker-discovery/dockertest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSyncContainers(t *testing.T) {
+	daemon := dockertest.New()
+	flaky, broken, gone := dockertest.ContainerID(0), dockertest.ContainerID(1), dockertest.ContainerID(2)
+	daemon.Add(dockertest.NewContainer(flaky, "flaky", dockertest.Endpoint{Network: "bridge", IPAddress: "172.17.0.2"}))
+	daemon.Add(dockertest.NewContainer(broken, "broken", dockertest.Endpoint{Network: "bridge", IPAddress: "172.17.0.3"}))
+	daemon.FailInspect(flaky, inspectAttempts-1)
+	daemon.FailInspect(broken, -1)
+
+	dd := newTestDiscovery(t, daemon, "docker {\n domain docker.loc\n sync_workers 2\n}")
+
+	err := dd.syncContainers([]types.Container{{ID: flaky}, {ID: broken}, {ID: gone}})
+	assert.Nil(t, err)
+
+	containerInfoData, _ := dd.containerInfoByDomain("flaky.docker.loc.")
+	assert.NotNil(t, containerInfoData)
+	containerInfoData, _ = dd.containerInfoByDomain("broken.docker.loc.")
+	assert.Nil(t, containerInfoData)
+	assert.Len(t, dd.containerInfoMap, 1)
+	assert.Equal(t, inspectAttempts+inspectAttempts+1, daemon.Inspects())
+}
+
+func TestSyncWorkersSetup(t *testing.T) {
+	for _, config := range []string{
+		"docker {\nsync_workers\n}",
+		"docker {\nsync_workers 0\n}",
+		"docker {\nsync_workers many\n}",
+	} {
+		_, err := createPlugin(caddy.NewTestController("dns", config))
+		assert.NotNil(t, err, config)
+	}
+}
+
+func BenchmarkInitialSync(b *testing.B) {
+	const count = 2000
+
+	daemon := dockertest.New()
+	daemon.InspectLatency = time.Millisecond
+	for i := 0; i < count; i++ {
+		daemon.Add(dockertest.NewContainer(dockertest.ContainerID(i), fmt.Sprintf("c%d", i), dockertest.Endpoint{
+			Network:   "bridge",
+			IPAddress: fmt.Sprintf("10.%d.%d.%d", i>>16&0xff, i>>8&0xff, i&0xff),
+		}))
+	}
+
+	for _, workers := range []int{1, defaultSyncWorkers, 32} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			dd := newTestDiscovery(b, daemon, fmt.Sprintf("docker {\n domain docker.loc\n sync_workers %d\n}", workers))
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := dd.resync(); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			if len(dd.containerInfoMap) != count {
+				b.Fatalf("expected %d containers, got %d", count, len(dd.containerInfoMap))
+			}
+		})
+	}
+}
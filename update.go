@@ -0,0 +1,456 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/miekg/dns"
+)
+
+// tsigFudge is the time difference allowed between the server and the
+// client verifying a response, in seconds.
+const tsigFudge = 300
+
+// tsigAlgorithms are the algorithms tsig_key accepts, by Corefile name.
+var tsigAlgorithms = map[string]string{
+	"hmac-sha1":   dns.HmacSHA1,
+	"hmac-sha224": dns.HmacSHA224,
+	"hmac-sha256": dns.HmacSHA256,
+	"hmac-sha384": dns.HmacSHA384,
+	"hmac-sha512": dns.HmacSHA512,
+}
+
+// tsigKey is a key dynamic updates are signed with.
+type tsigKey struct {
+	algorithm string
+	secret    string // base64
+}
+
+// updateRegistry holds the records added by dynamic updates, RFC 2136, for
+// names that are not containers'. They are kept apart from the container
+// records and persisted to a file after every update.
+type updateRegistry struct {
+	file    string
+	mutex   sync.RWMutex
+	records map[string][]dns.RR // by lowercased owner name
+}
+
+func newUpdateRegistry(file string) *updateRegistry {
+	return &updateRegistry{file: file, records: make(map[string][]dns.RR)}
+}
+
+// load reads the records of the file. A missing file is not an error.
+func (u *updateRegistry) load() error {
+	f, err := os.Open(u.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	records := make(map[string][]dns.RR)
+	zp := dns.NewZoneParser(f, ".", u.file)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		name := strings.ToLower(rr.Header().Name)
+		records[name] = append(records[name], rr)
+	}
+	if err := zp.Err(); err != nil {
+		return fmt.Errorf("unable to read the updated records: %v", err)
+	}
+
+	u.mutex.Lock()
+	u.records = records
+	u.mutex.Unlock()
+	return nil
+}
+
+// save writes records to the file, replacing it atomically.
+func (u *updateRegistry) save(records map[string][]dns.RR) error {
+	names := make([]string, 0, len(records))
+	for name := range records {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	buf.WriteString("; Written by the coredns docker plugin on dynamic updates.\n")
+	for _, name := range names {
+		for _, rr := range records[name] {
+			buf.WriteString(rr.String())
+			buf.WriteByte('\n')
+		}
+	}
+	return writeFileAtomic(u.file, buf.Bytes(), 0600)
+}
+
+// lookup returns the records of name with type qtype, or its CNAME. It
+// reports whether name has any records.
+func (u *updateRegistry) lookup(name string, qtype uint16) ([]dns.RR, bool) {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+
+	records, ok := u.records[strings.ToLower(name)]
+	var answers []dns.RR
+	for _, rr := range records {
+		if rr.Header().Rrtype == qtype || rr.Header().Rrtype == dns.TypeCNAME {
+			answers = append(answers, dns.Copy(rr))
+		}
+	}
+	return answers, ok
+}
+
+// startUpdates starts accepting dynamic updates on the update address, over
+// UDP and TCP. CoreDNS hands plugins the parsed message only and rejects
+// updates before they reach them, so the plugin listens itself: miekg/dns
+// verifies the TSIG of an update on the message as received.
+func (dd *Discovery) startUpdates() error {
+	if dd.updates == nil {
+		return nil
+	}
+	pc, err := net.ListenPacket("udp", dd.updateAddress)
+	if err != nil {
+		return fmt.Errorf("unable to listen for updates on %s: %v", dd.updateAddress, err)
+	}
+	// the port UDP got, which differs from the address with port 0
+	ln, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close()
+		return fmt.Errorf("unable to listen for updates on %s: %v", dd.updateAddress, err)
+	}
+
+	secrets := make(map[string]string, len(dd.tsigKeys))
+	for name, key := range dd.tsigKeys {
+		secrets[name] = key.secret
+	}
+	handler := dns.HandlerFunc(dd.serveUpdate)
+	servers := []*dns.Server{
+		{PacketConn: pc, Net: "udp", Handler: handler, TsigSecret: secrets, MsgAcceptFunc: acceptUpdate},
+		{Listener: ln, Net: "tcp", Handler: handler, TsigSecret: secrets, MsgAcceptFunc: acceptUpdate},
+	}
+	for _, server := range servers {
+		// Shutdown fails on a server that has not started yet.
+		started := make(chan struct{})
+		server.NotifyStartedFunc = func() { close(started) }
+		failed := make(chan struct{})
+		dd.wg.Add(1)
+		go func(server *dns.Server) {
+			defer dd.wg.Done()
+			if err := server.ActivateAndServe(); err != nil {
+				log.Errorf("[zone/%s] update listener on %s stopped: %s", dd.Zone, dd.updateAddress, err)
+			}
+			close(failed)
+		}(server)
+		select {
+		case <-started:
+		case <-failed:
+		}
+	}
+
+	dd.updateMutex.Lock()
+	dd.updateServers = servers
+	dd.updateMutex.Unlock()
+	log.Infof("[zone/%s] Accepting dynamic updates on %s", dd.Zone, pc.LocalAddr())
+	return nil
+}
+
+// stopUpdates stops accepting dynamic updates, releasing the update address
+// for the instance started by a reload.
+func (dd *Discovery) stopUpdates() error {
+	dd.updateMutex.Lock()
+	servers := dd.updateServers
+	dd.updateServers = nil
+	dd.updateMutex.Unlock()
+
+	var err error
+	for _, server := range servers {
+		ctx, cancel := context.WithTimeout(context.Background(), debugShutdownTimeout)
+		if serr := server.ShutdownContext(ctx); serr != nil && err == nil {
+			err = serr
+		}
+		cancel()
+	}
+	return err
+}
+
+// acceptUpdate accepts dynamic updates, which the default of miekg/dns
+// rejects, and nothing else.
+func acceptUpdate(dh dns.Header) dns.MsgAcceptAction {
+	if dh.Bits&(1<<15) != 0 { // a response
+		return dns.MsgIgnore
+	}
+	if int(dh.Bits>>11)&0xF != dns.OpcodeUpdate {
+		return dns.MsgRejectNotImplemented
+	}
+	if dh.Qdcount != 1 {
+		return dns.MsgReject
+	}
+	return dns.MsgAccept
+}
+
+// serveUpdate answers a dynamic update. Updates must be signed with one of
+// the TSIG keys, the response is signed with the same key.
+func (dd *Discovery) serveUpdate(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+
+	zone := plugin.Zones(dd.Zones).Matches(r.Question[0].Name)
+	key, rcode := dd.verifyUpdate(w, r)
+	switch {
+	case rcode != dns.RcodeSuccess:
+	case zone == "":
+		rcode = dns.RcodeNotAuth
+	default:
+		rcode = dd.applyUpdate(r, zone)
+	}
+	m.Rcode = rcode
+	if zone != "" {
+		dd.metrics.counter(metricsDockerUpdates, zone, dns.RcodeToString[rcode]).Inc()
+	}
+
+	if tsig := r.IsTsig(); key != nil {
+		// signed by the server with the secret of the key name
+		m.SetTsig(tsig.Hdr.Name, tsig.Algorithm, tsigFudge, time.Now().Unix())
+	}
+	if err := w.WriteMsg(m); err != nil {
+		log.Infof("[zone/%s] Error: %s", dd.Zone, err.Error())
+	}
+}
+
+// verifyUpdate checks the TSIG of an update, which the server verified on the
+// message as received. It returns the key the update is signed with, nil
+// when it is not signed with a known key.
+func (dd *Discovery) verifyUpdate(w dns.ResponseWriter, r *dns.Msg) (*tsigKey, int) {
+	tsig := r.IsTsig()
+	if tsig == nil {
+		log.Warningf("[zone/%s] Refusing an unsigned update", dd.Zone)
+		return nil, dns.RcodeRefused
+	}
+	key, ok := dd.tsigKeys[tsig.Hdr.Name]
+	if !ok || !strings.EqualFold(tsig.Algorithm, key.algorithm) {
+		log.Warningf("[zone/%s] Refusing an update signed with the unknown key %s (%s)", dd.Zone, tsig.Hdr.Name, tsig.Algorithm)
+		return nil, dns.RcodeNotAuth
+	}
+	if err := w.TsigStatus(); err != nil {
+		log.Warningf("[zone/%s] Refusing an update signed with %s: %s", dd.Zone, tsig.Hdr.Name, err)
+		return nil, dns.RcodeNotAuth
+	}
+	return &key, dns.RcodeSuccess
+}
+
+// applyUpdate checks the prerequisites of an update for zone and applies it
+// as a whole, or not at all. Names held by containers cannot be updated.
+func (dd *Discovery) applyUpdate(r *dns.Msg, zone string) int {
+	if len(r.Question) != 1 || r.Question[0].Qtype != dns.TypeSOA {
+		return dns.RcodeFormatError
+	}
+	if !strings.EqualFold(r.Question[0].Name, zone) {
+		return dns.RcodeNotAuth
+	}
+
+	dd.updates.mutex.Lock()
+	defer dd.updates.mutex.Unlock()
+
+	if rcode := dd.checkPrerequisites(r.Answer, zone); rcode != dns.RcodeSuccess {
+		return rcode
+	}
+	for _, rr := range r.Ns {
+		if rcode := dd.checkUpdate(rr, zone); rcode != dns.RcodeSuccess {
+			return rcode
+		}
+	}
+
+	records := make(map[string][]dns.RR, len(dd.updates.records))
+	for name, rrs := range dd.updates.records {
+		records[name] = rrs
+	}
+	for _, rr := range r.Ns {
+		name := strings.ToLower(rr.Header().Name)
+		records[name] = applyRecord(records[name], rr)
+		if len(records[name]) == 0 {
+			delete(records, name)
+		}
+	}
+	if err := dd.updates.save(records); err != nil {
+		log.Errorf("[zone/%s] Unable to save the updated records: %s", dd.Zone, err)
+		return dns.RcodeServerFailure
+	}
+	dd.updates.records = records
+	return dns.RcodeSuccess
+}
+
+// checkPrerequisites checks the prerequisites of an update, RFC 2136
+// section 3.2, against the records of containers and of earlier updates.
+// The caller holds the lock of the updates.
+func (dd *Discovery) checkPrerequisites(prerequisites []dns.RR, zone string) int {
+	type rrset struct {
+		name  string
+		rtype uint16
+	}
+	var values map[rrset][]dns.RR // RRsets that must exist with exactly these records
+	for _, rr := range prerequisites {
+		hdr := rr.Header()
+		if !dns.IsSubDomain(zone, hdr.Name) {
+			return dns.RcodeNotZone
+		}
+		if hdr.Ttl != 0 {
+			return dns.RcodeFormatError
+		}
+		switch hdr.Class {
+		case dns.ClassANY, dns.ClassNONE:
+			if hdr.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+			found := false
+			for _, e := range dd.existingRecords(hdr.Name) {
+				found = found || hdr.Rrtype == dns.TypeANY || e.Header().Rrtype == hdr.Rrtype
+			}
+			switch {
+			case hdr.Class == dns.ClassANY && !found && hdr.Rrtype == dns.TypeANY:
+				return dns.RcodeNameError
+			case hdr.Class == dns.ClassANY && !found:
+				return dns.RcodeNXRrset
+			case hdr.Class == dns.ClassNONE && found && hdr.Rrtype == dns.TypeANY:
+				return dns.RcodeYXDomain
+			case hdr.Class == dns.ClassNONE && found:
+				return dns.RcodeYXRrset
+			}
+		case dns.ClassINET:
+			if values == nil {
+				values = make(map[rrset][]dns.RR)
+			}
+			key := rrset{strings.ToLower(hdr.Name), hdr.Rrtype}
+			values[key] = append(values[key], rr)
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+
+	for key, expected := range values {
+		var existing []dns.RR
+		for _, e := range dd.existingRecords(key.name) {
+			if e.Header().Rrtype == key.rtype {
+				existing = append(existing, e)
+			}
+		}
+		if !sameRecords(existing, expected) {
+			return dns.RcodeNXRrset
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// sameRecords reports whether a and b hold the same records, whatever their
+// TTL and order.
+func sameRecords(a, b []dns.RR) bool {
+	contains := func(records []dns.RR, rr dns.RR) bool {
+		for _, r := range records {
+			if dns.IsDuplicate(r, rr) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, rr := range a {
+		if !contains(b, rr) {
+			return false
+		}
+	}
+	for _, rr := range b {
+		if !contains(a, rr) {
+			return false
+		}
+	}
+	return true
+}
+
+// existingRecords returns the records of name, those of the container
+// holding it or else those of earlier updates.
+func (dd *Discovery) existingRecords(name string) []dns.RR {
+	if info, _ := dd.containerInfoByDomain(dns.Fqdn(strings.ToLower(name))); info != nil {
+		address, addressv6 := dd.addressesFor(info, name)
+		return append(dd.a(name, []net.IP{address}), dd.aaaa(name, []net.IP{addressv6})...)
+	}
+	return dd.updates.records[strings.ToLower(name)]
+}
+
+// checkUpdate checks a record of the update section, RFC 2136 section
+// 3.4.1.
+func (dd *Discovery) checkUpdate(rr dns.RR, zone string) int {
+	hdr := rr.Header()
+	if !dns.IsSubDomain(zone, hdr.Name) {
+		return dns.RcodeNotZone
+	}
+	switch hdr.Class {
+	case dns.ClassINET:
+		switch hdr.Rrtype {
+		case dns.TypeANY, dns.TypeAXFR, dns.TypeIXFR, dns.TypeMAILA, dns.TypeMAILB, dns.TypeTSIG, dns.TypeOPT:
+			return dns.RcodeFormatError
+		case dns.TypeSOA, dns.TypeNS:
+			return dns.RcodeRefused
+		}
+	case dns.ClassANY:
+		if hdr.Ttl != 0 || hdr.Rdlength != 0 {
+			return dns.RcodeFormatError
+		}
+	case dns.ClassNONE:
+		if hdr.Ttl != 0 || hdr.Rrtype == dns.TypeANY {
+			return dns.RcodeFormatError
+		}
+	default:
+		return dns.RcodeFormatError
+	}
+	if info, _ := dd.containerInfoByDomain(dns.Fqdn(strings.ToLower(hdr.Name))); info != nil {
+		log.Warningf("[zone/%s] Refusing an update of %s, the name of container %s", dd.Zone, hdr.Name, normalizeContainerName(info.container))
+		return dns.RcodeRefused
+	}
+	if _, ok := dd.staticRecords(hdr.Name, hdr.Rrtype); ok {
+		log.Warningf("[zone/%s] Refusing an update of %s, a name of the Corefile", dd.Zone, hdr.Name)
+		return dns.RcodeRefused
+	}
+	return dns.RcodeSuccess
+}
+
+// applyRecord applies a record of the update section to the records of its
+// name, RFC 2136 section 3.4.2, returning them without changing records.
+func applyRecord(records []dns.RR, rr dns.RR) []dns.RR {
+	hdr := rr.Header()
+	var kept []dns.RR
+	switch hdr.Class {
+	case dns.ClassINET:
+		for _, e := range records {
+			if dns.IsDuplicate(e, rr) {
+				return records
+			}
+			// a CNAME cannot coexist with other records
+			if (e.Header().Rrtype == dns.TypeCNAME) != (hdr.Rrtype == dns.TypeCNAME) {
+				return records
+			}
+		}
+		return append(append(kept, records...), dns.Copy(rr))
+	case dns.ClassANY:
+		for _, e := range records {
+			if hdr.Rrtype != dns.TypeANY && e.Header().Rrtype != hdr.Rrtype {
+				kept = append(kept, e)
+			}
+		}
+	case dns.ClassNONE:
+		match := dns.Copy(rr)
+		match.Header().Class = dns.ClassINET
+		for _, e := range records {
+			if !dns.IsDuplicate(e, match) {
+				kept = append(kept, e)
+			}
+		}
+	}
+	return kept
+}
@@ -0,0 +1,240 @@
+package docker
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/miekg/dns"
+	"github.com/rb-coredns/coredns-docker-discovery/dockertest"
+	"github.com/stretchr/testify/assert"
+)
+
+const testTSIGSecret = "c2VjcmV0IG9mIHRoZSB1cGRhdGUga2V5"
+
+// updateAddr returns the address the update listener of dd got.
+func updateAddr(t *testing.T, dd *Discovery) string {
+	dd.updateMutex.Lock()
+	defer dd.updateMutex.Unlock()
+	if len(dd.updateServers) == 0 {
+		t.Fatal("not accepting updates")
+	}
+	return dd.updateServers[0].PacketConn.LocalAddr().String()
+}
+
+// update sends a dynamic update for docker.loc to the update listener,
+// signed with secret unless it is empty, and returns the response. The
+// client verifies the signature of the response.
+func update(t *testing.T, dd *Discovery, secret string, build func(m *dns.Msg)) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetUpdate("docker.loc.")
+	build(m)
+	c := new(dns.Client)
+	if secret != "" {
+		m.SetTsig("update.key.", dns.HmacSHA256, 300, time.Now().Unix())
+		c.TsigSecret = map[string]string{"update.key.": secret}
+	}
+	resp, _, err := c.Exchange(m, updateAddr(t, dd))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func newRR(t *testing.T, s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+func TestUpdate(t *testing.T) {
+	daemon := dockertest.New()
+	web := dockertest.ContainerID(0)
+	daemon.Add(dockertest.NewContainer(web, "web", dockertest.Endpoint{Network: "bridge", IPAddress: "172.17.0.2"}))
+	file := filepath.Join(t.TempDir(), "updates.db")
+	dd := newTestDiscovery(t, daemon, "docker {\n domain docker.loc\n update "+file+" 127.0.0.1:0\n tsig_key update.key "+testTSIGSecret+"\n}")
+	startTestDiscovery(t, dd)
+
+	resp := update(t, dd, testTSIGSecret, func(m *dns.Msg) {
+		m.Insert([]dns.RR{newRR(t, "gateway.docker.loc. 300 IN A 172.17.0.1"), newRR(t, "vm.docker.loc. 300 IN CNAME gateway.docker.loc.")})
+	})
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.NotNil(t, resp.IsTsig())
+
+	_, m := lookup(dd, "gateway.docker.loc", dns.TypeA)
+	assert.Equal(t, []string{"172.17.0.1"}, answerIPs(m))
+	_, m = lookup(dd, "vm.docker.loc", dns.TypeA)
+	if assert.Len(t, m.Answer, 2) {
+		assert.Equal(t, "gateway.docker.loc.", m.Answer[0].(*dns.CNAME).Target)
+	}
+	assert.Equal(t, []string{"172.17.0.1"}, answerIPs(m))
+	_, m = lookup(dd, "gateway.docker.loc", dns.TypeTXT)
+	assert.True(t, isNoData(m))
+
+	// Names of containers are protected.
+	resp = update(t, dd, testTSIGSecret, func(m *dns.Msg) {
+		m.Insert([]dns.RR{newRR(t, "web.docker.loc. 300 IN A 10.0.0.1")})
+	})
+	assert.Equal(t, dns.RcodeRefused, resp.Rcode)
+	_, m = lookup(dd, "web.docker.loc", dns.TypeA)
+	assert.Equal(t, []string{"172.17.0.2"}, answerIPs(m))
+
+	// Prerequisites are checked against both.
+	resp = update(t, dd, testTSIGSecret, func(m *dns.Msg) {
+		m.NameNotUsed([]dns.RR{newRR(t, "gateway.docker.loc. 0 IN A 0.0.0.0")})
+		m.Insert([]dns.RR{newRR(t, "gateway.docker.loc. 300 IN A 172.17.0.254")})
+	})
+	assert.Equal(t, dns.RcodeYXDomain, resp.Rcode)
+	resp = update(t, dd, testTSIGSecret, func(m *dns.Msg) {
+		m.Used([]dns.RR{newRR(t, "web.docker.loc. 0 IN A 172.17.0.2")})
+		m.Insert([]dns.RR{newRR(t, "web-vm.docker.loc. 300 IN A 172.17.0.3")})
+	})
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+
+	// The records are kept in the file.
+	restarted := newUpdateRegistry(file)
+	assert.NoError(t, restarted.load())
+	records, ok := restarted.lookup("GATEWAY.docker.loc.", dns.TypeA)
+	assert.True(t, ok)
+	assert.Len(t, records, 1)
+
+	resp = update(t, dd, testTSIGSecret, func(m *dns.Msg) {
+		m.RemoveName([]dns.RR{newRR(t, "gateway.docker.loc. 0 IN A 0.0.0.0")})
+	})
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	rcode, _ := lookup(dd, "gateway.docker.loc", dns.TypeA)
+	assert.Equal(t, dns.RcodeRefused, rcode)
+}
+
+func TestUpdateStrict(t *testing.T) {
+	daemon := dockertest.New()
+	file := filepath.Join(t.TempDir(), "updates.db")
+	dd := newTestDiscovery(t, daemon, "docker {\n domain docker.loc\n strict\n update "+file+" 127.0.0.1:0\n tsig_key update.key "+testTSIGSecret+"\n}")
+	startTestDiscovery(t, dd)
+
+	resp := update(t, dd, testTSIGSecret, func(m *dns.Msg) {
+		m.Insert([]dns.RR{newRR(t, "gateway.docker.loc. 300 IN A 172.17.0.1")})
+	})
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+
+	// Updated names do not depend on docker.
+	atomic.StoreInt64(&dd.staleSince, time.Now().Add(-time.Second).UnixNano())
+	rcode, m := lookup(dd, "gateway.docker.loc", dns.TypeA)
+	assert.Equal(t, dns.RcodeSuccess, rcode)
+	assert.Equal(t, []string{"172.17.0.1"}, answerIPs(m))
+	rcode, _ = lookup(dd, "web.docker.loc", dns.TypeA)
+	assert.Equal(t, dns.RcodeServerFailure, rcode)
+}
+
+func TestUpdateAuth(t *testing.T) {
+	daemon := dockertest.New()
+	file := filepath.Join(t.TempDir(), "updates.db")
+	dd := newTestDiscovery(t, daemon, "docker {\n domain docker.loc\n update "+file+" 127.0.0.1:0\n tsig_key update.key "+testTSIGSecret+"\n}")
+	startTestDiscovery(t, dd)
+
+	insert := func(m *dns.Msg) { m.Insert([]dns.RR{newRR(t, "gateway.docker.loc. 300 IN A 172.17.0.1")}) }
+	resp := update(t, dd, "", insert)
+	assert.Equal(t, dns.RcodeRefused, resp.Rcode)
+	resp = update(t, dd, "b3RoZXIgc2VjcmV0", insert)
+	assert.Equal(t, dns.RcodeNotAuth, resp.Rcode)
+	assert.Nil(t, resp.IsTsig())
+
+	rcode, _ := lookup(dd, "gateway.docker.loc", dns.TypeA)
+	assert.Equal(t, dns.RcodeRefused, rcode)
+}
+
+// TestUpdateWire sends an update whose names are compressed differently from
+// how miekg/dns packs them, as other clients may: the owner name points to
+// the zone, the CNAME target is written in full. The TSIG covers these bytes,
+// RFC 8945 section 4.3.3, and is computed here without miekg/dns.
+func TestUpdateWire(t *testing.T) {
+	daemon := dockertest.New()
+	daemon.Add(dockertest.NewContainer(dockertest.ContainerID(0), "web", dockertest.Endpoint{Network: "bridge", IPAddress: "172.17.0.2"}))
+	file := filepath.Join(t.TempDir(), "updates.db")
+	dd := newTestDiscovery(t, daemon, "docker {\n domain docker.loc\n update "+file+" 127.0.0.1:0\n tsig_key update.key "+testTSIGSecret+"\n}")
+	startTestDiscovery(t, dd)
+
+	name := func(labels ...string) []byte {
+		var b []byte
+		for _, l := range labels {
+			b = append(append(b, byte(len(l))), l...)
+		}
+		return append(b, 0)
+	}
+	u16 := func(v uint16) []byte { return []byte{byte(v >> 8), byte(v)} }
+	u48 := func(v int64) []byte {
+		return []byte{byte(v >> 40), byte(v >> 32), byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}
+	}
+	cat := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+
+	target := name("web", "docker", "loc")
+	body := cat(
+		name("docker", "loc"), u16(dns.TypeSOA), u16(dns.ClassINET), // zone
+		[]byte{2, 'v', 'm', 0xc0, 12}, u16(dns.TypeCNAME), u16(dns.ClassINET), []byte{0, 0, 1, 44}, u16(uint16(len(target))), target,
+	)
+	header := func(arcount uint16) []byte {
+		return cat(u16(0x1234), u16(dns.OpcodeUpdate<<11), u16(1), u16(0), u16(1), u16(arcount))
+	}
+	key, algorithm, now := name("update", "key"), name("hmac-sha256"), time.Now().Unix()
+	secret, _ := base64.StdEncoding.DecodeString(testTSIGSecret)
+	h := hmac.New(sha256.New, secret)
+	h.Write(cat(header(0), body, key, u16(dns.ClassANY), []byte{0, 0, 0, 0}, algorithm, u48(now), u16(300), u16(0), u16(0)))
+	mac := h.Sum(nil)
+	rdata := cat(algorithm, u48(now), u16(300), u16(uint16(len(mac))), mac, u16(0x1234), u16(0), u16(0))
+	wire := cat(header(1), body, key, u16(dns.TypeTSIG), u16(dns.ClassANY), []byte{0, 0, 0, 0}, u16(uint16(len(rdata))), rdata)
+
+	conn, err := net.Dial("udp", updateAddr(t, dd))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = conn.Write(wire); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, dns.MinMsgSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := new(dns.Msg)
+	if assert.NoError(t, resp.Unpack(buf[:n])) {
+		assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+		assert.NoError(t, dns.TsigVerify(buf[:n], testTSIGSecret, hex.EncodeToString(mac), false))
+	}
+
+	_, m := lookup(dd, "vm.docker.loc", dns.TypeA)
+	assert.Equal(t, []string{"172.17.0.2"}, answerIPs(m))
+}
+
+func TestUpdateSetup(t *testing.T) {
+	dd, err := createPlugin(caddy.NewTestController("dns", "docker {\n update /tmp/updates.db 127.0.0.1:5353\n tsig_key Update.Key "+testTSIGSecret+" hmac-sha512\n}"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "/tmp/updates.db", dd.updates.file)
+		assert.Equal(t, "127.0.0.1:5353", dd.updateAddress)
+		assert.Equal(t, tsigKey{algorithm: dns.HmacSHA512, secret: testTSIGSecret}, dd.tsigKeys["update.key."])
+	}
+
+	for _, config := range []string{
+		"docker {\n update\n}",
+		"docker {\n update /tmp/updates.db\n tsig_key update.key " + testTSIGSecret + "\n}",
+		"docker {\n update /tmp/updates.db 5353\n tsig_key update.key " + testTSIGSecret + "\n}",
+		"docker {\n update /tmp/updates.db 127.0.0.1:5353\n}",
+		"docker {\n tsig_key update.key " + testTSIGSecret + "\n}",
+		"docker {\n update /tmp/updates.db 127.0.0.1:5353\n tsig_key update.key not-base64!\n}",
+		"docker {\n update /tmp/updates.db 127.0.0.1:5353\n tsig_key update.key " + testTSIGSecret + " hmac-md5\n}",
+	} {
+		_, err := createPlugin(caddy.NewTestController("dns", config))
+		assert.NotNil(t, err, config)
+	}
+}